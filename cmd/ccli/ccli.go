@@ -1,18 +1,31 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/urfave/cli"
 
 	"github.com/KyberNetwork/cclog/lib/client"
+	"github.com/KyberNetwork/cclog/lib/common"
 )
 
 const (
-	flagRemoteAddr = "remote-addr"
-	flagName       = "name"
+	flagRemoteAddr    = "remote-addr"
+	flagName          = "name"
+	flagTLS           = "tls"
+	flagTLSCA         = "tls-ca"
+	flagTLSCert       = "tls-cert"
+	flagTLSKey        = "tls-key"
+	flagTLSServerName = "tls-server-name"
+	flagToken         = "token"
+	flagHMACKeyID     = "hmac-key-id"
+	flagHMACKey       = "hmac-key"
+	flagCompression   = "compression"
+	flagLabel         = "label"
 )
 
 func main() {
@@ -34,6 +47,56 @@ func main() {
 			Value:  "test",
 			EnvVar: "LOG_NAME",
 		},
+		cli.BoolFlag{
+			Name:   flagTLS,
+			Usage:  "connect to server over TLS, it is enabled if any other tls flag is set",
+			EnvVar: "TLS",
+		},
+		cli.StringFlag{
+			Name:   flagTLSCA,
+			Usage:  "ca file to verify server certificate, use system roots if empty",
+			EnvVar: "TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   flagTLSCert,
+			Usage:  "client certificate file",
+			EnvVar: "TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   flagTLSKey,
+			Usage:  "client private key file",
+			EnvVar: "TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   flagTLSServerName,
+			Usage:  "server name to verify server certificate, default to host of remote address",
+			EnvVar: "TLS_SERVER_NAME",
+		},
+		cli.StringFlag{
+			Name:   flagToken,
+			Usage:  "static token to authenticate to server",
+			EnvVar: "TOKEN",
+		},
+		cli.StringFlag{
+			Name:   flagHMACKeyID,
+			Usage:  "id of hmac key to sign token",
+			EnvVar: "HMAC_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   flagHMACKey,
+			Usage:  "hex encoded hmac key to sign token, used instead of static token if set",
+			EnvVar: "HMAC_KEY",
+		},
+		cli.StringFlag{
+			Name:   flagCompression,
+			Usage:  fmt.Sprintf("codec to compress data, one of %s", strings.Join(common.CodecNames(), ", ")),
+			Value:  common.CodecLZ4,
+			EnvVar: "COMPRESSION",
+		},
+		cli.StringSliceFlag{
+			Name:  flagLabel,
+			Usage: "label of client in key=value form, can be repeated",
+		},
 	)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Println("run error", err)
@@ -46,10 +109,51 @@ func run(c *cli.Context) error {
 		fmt.Println("nothing to send")
 		return nil
 	}
-	w2 := client.NewSyncLogClient(c.String(flagName), c.String(flagRemoteAddr))
+	codec := c.String(flagCompression)
+	if _, ok := common.GetCodec(codec); !ok {
+		return fmt.Errorf("unknown compression %s, available: %s", codec, strings.Join(common.CodecNames(), ", "))
+	}
+	opts := []client.Option{client.WithCodec(codec)}
+	if values := c.StringSlice(flagLabel); len(values) > 0 {
+		labels := make(map[string]string, len(values))
+		for _, v := range values {
+			i := strings.IndexByte(v, '=')
+			if i <= 0 {
+				return fmt.Errorf("invalid label %s, should be key=value", v)
+			}
+			labels[v[:i]] = v[i+1:]
+		}
+		if err := common.ValidateLabels(labels); err != nil {
+			return err
+		}
+		opts = append(opts, client.WithLabels(labels))
+	}
+	if c.Bool(flagTLS) || c.String(flagTLSCA) != "" || c.String(flagTLSCert) != "" ||
+		c.String(flagTLSServerName) != "" {
+		tlsConfig, err := common.NewClientTLSConfig(c.String(flagTLSCA), c.String(flagTLSCert),
+			c.String(flagTLSKey), c.String(flagTLSServerName))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, client.WithTLS(tlsConfig))
+	}
+	if c.String(flagToken) != "" {
+		opts = append(opts, client.WithToken(c.String(flagToken)))
+	}
+	if c.String(flagHMACKey) != "" {
+		key, err := hex.DecodeString(c.String(flagHMACKey))
+		if err != nil {
+			return fmt.Errorf("invalid hmac key, %w", err)
+		}
+		opts = append(opts, client.WithHMACKey(c.String(flagHMACKeyID), key))
+	}
+	w2 := client.NewSyncLogClient(c.String(flagName), c.String(flagRemoteAddr), opts...)
 	n, err := io.Copy(w2, os.Stdin)
 	if err != nil {
 		fmt.Println("write failed", err)
+	}
+	if cErr := w2.Close(); cErr != nil {
+		fmt.Println("close failed, data may be lost", cErr)
 		return nil
 	}
 	fmt.Println("done with", n, "bytes")
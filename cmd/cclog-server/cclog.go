@@ -1,19 +1,62 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // time zones when host has no zoneinfo
 
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
 
 	"github.com/KyberNetwork/cclog/lib/app"
+	"github.com/KyberNetwork/cclog/lib/common"
 	"github.com/KyberNetwork/cclog/lib/server"
 )
 
 const (
-	flagBaseDir     = "base-dir"
-	flagBindAddr    = "bind-addr"
-	flagMaxFileSize = "max-file-size"
+	flagBaseDir          = "base-dir"
+	flagBindAddr         = "bind-addr"
+	flagMaxFileSize      = "max-file-size"
+	flagTLSCert          = "tls-cert"
+	flagTLSKey           = "tls-key"
+	flagTLSClientCA      = "tls-client-ca"
+	flagTLSRestrictNames = "tls-restrict-names"
+	flagACLFile          = "acl-file"
+	flagMaxLineLength    = "max-line-length"
+	flagStreamConfig     = "stream-config"
+	flagEnrich           = "enrich"
+	flagAdminAddr        = "admin-addr"
+	flagFileTemplate     = "file-template"
+	flagBackupTemplate   = "backup-template"
+	flagRotateSchedule   = "rotate-schedule"
+	flagRotateMaxLines   = "rotate-max-lines"
+	flagRotateMaxAge     = "rotate-max-age"
+	flagRotateIdle       = "rotate-idle"
+	flagTimeZone         = "time-zone"
+	flagCompress         = "compress"
+	flagCompressLevel    = "compress-level"
+	flagCompressWorkers  = "compress-concurrency"
+	flagRetentionMaxAge  = "retention-max-age"
+	flagRetentionBytes   = "retention-max-bytes"
+	flagRetentionTotal   = "retention-max-total-bytes"
+	flagRetentionDryRun  = "retention-dry-run"
+	flagRetentionAudit   = "retention-audit-log"
+	flagRetentionEvery   = "retention-interval"
+	flagDiskSoft         = "disk-soft-watermark"
+	flagDiskHard         = "disk-hard-watermark"
+	flagDiskInterval     = "disk-check-interval"
+	flagSync             = "sync"
+	flagSyncInterval     = "sync-interval"
+	flagSyncBytes        = "sync-bytes"
+	flagWriteBuffer      = "write-buffer"
+	flagFlushInterval    = "flush-interval"
+	flagWriterIdle       = "writer-idle-timeout"
+	flagMaxOpenFiles     = "max-open-files"
 )
 
 var sugar = zap.NewExample().Sugar()
@@ -43,6 +86,192 @@ func main() {
 			Value:  2048,
 			EnvVar: "MAX_FILE_SIZE",
 		},
+		cli.StringFlag{
+			Name:   flagTLSCert,
+			Usage:  "server certificate file, enable TLS if set",
+			EnvVar: "TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   flagTLSKey,
+			Usage:  "server private key file",
+			EnvVar: "TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   flagTLSClientCA,
+			Usage:  "ca file to verify client certificate, client certificate is required if set",
+			EnvVar: "TLS_CLIENT_CA",
+		},
+		cli.BoolFlag{
+			Name:   flagTLSRestrictNames,
+			Usage:  "only allow client to write to names matching CN or DNS SAN of its certificate",
+			EnvVar: "TLS_RESTRICT_NAMES",
+		},
+		cli.StringFlag{
+			Name:   flagACLFile,
+			Usage:  "json file maps tokens to allowed names, clients must authenticate if set",
+			EnvVar: "ACL_FILE",
+		},
+		cli.IntFlag{
+			Name:   flagMaxLineLength,
+			Usage:  "max line length in bytes, longer lines are split",
+			Value:  1 << 20,
+			EnvVar: "MAX_LINE_LENGTH",
+		},
+		cli.StringFlag{
+			Name:   flagStreamConfig,
+			Usage:  "json file of default and per name stream settings",
+			EnvVar: "STREAM_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   flagEnrich,
+			Usage:  "add receive time and client info to each line: none, prefix or wrap, overrides default of stream config",
+			EnvVar: "ENRICH",
+		},
+		cli.StringFlag{
+			Name:   flagAdminAddr,
+			Usage:  "bind address of admin http api, disabled if empty",
+			EnvVar: "ADMIN_ADDR",
+		},
+		cli.StringFlag{
+			Name:   flagFileTemplate,
+			Usage:  "path of log file relative to base dir, placeholders: {name} {host} {instance} {label.<key>} {yyyy} {mm} {dd} {hh}",
+			Value:  server.DefaultFileTemplate,
+			EnvVar: "FILE_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   flagBackupTemplate,
+			Usage:  "file name of rotated log, placeholders: {base} {ext}, {yyyy} {mm} {dd} {hh} {mi} {ss} of first write, {end.yyyy} .. {end.ss} of last write",
+			Value:  server.DefaultBackupTemplate,
+			EnvVar: "BACKUP_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   flagRotateSchedule,
+			Usage:  "cron spec to rotate files like \"0 * * * *\" or @hourly, none to disable, default @daily, overrides default of stream config",
+			EnvVar: "ROTATE_SCHEDULE",
+		},
+		cli.Uint64Flag{
+			Name:   flagRotateMaxLines,
+			Usage:  "rotate file after this number of lines, overrides default of stream config",
+			EnvVar: "ROTATE_MAX_LINES",
+		},
+		cli.DurationFlag{
+			Name:   flagRotateMaxAge,
+			Usage:  "rotate file this long after it is opened, overrides default of stream config",
+			EnvVar: "ROTATE_MAX_AGE",
+		},
+		cli.DurationFlag{
+			Name:   flagRotateIdle,
+			Usage:  "rotate file which is not written for this long, overrides default of stream config",
+			EnvVar: "ROTATE_IDLE",
+		},
+		cli.StringFlag{
+			Name:   flagTimeZone,
+			Usage:  "time zone of rotation schedules and times in file names, like UTC, Local or Asia/Ho_Chi_Minh",
+			Value:  "UTC",
+			EnvVar: "TIME_ZONE",
+		},
+		cli.StringFlag{
+			Name:   flagCompress,
+			Usage:  "compress rotated files: none, gzip or zstd",
+			Value:  server.CompressNone,
+			EnvVar: "COMPRESS",
+		},
+		cli.IntFlag{
+			Name:   flagCompressLevel,
+			Usage:  "compression level of rotated files, 0 is default level of the algorithm",
+			EnvVar: "COMPRESS_LEVEL",
+		},
+		cli.IntFlag{
+			Name:   flagCompressWorkers,
+			Usage:  "max number of files compressed at the same time",
+			Value:  2,
+			EnvVar: "COMPRESS_CONCURRENCY",
+		},
+		cli.DurationFlag{
+			Name:   flagRetentionMaxAge,
+			Usage:  "delete rotated files last written longer ago, overrides default of stream config",
+			EnvVar: "RETENTION_MAX_AGE",
+		},
+		cli.Uint64Flag{
+			Name:   flagRetentionBytes,
+			Usage:  "max MB of files of each stream, oldest rotated files are deleted first, overrides default of stream config",
+			EnvVar: "RETENTION_MAX_BYTES",
+		},
+		cli.Uint64Flag{
+			Name:   flagRetentionTotal,
+			Usage:  "max MB of files in base dir, oldest rotated files are deleted first",
+			EnvVar: "RETENTION_MAX_TOTAL_BYTES",
+		},
+		cli.BoolFlag{
+			Name:   flagRetentionDryRun,
+			Usage:  "only log files retention would delete",
+			EnvVar: "RETENTION_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   flagRetentionAudit,
+			Usage:  "file to append json lines of deleted files, stdout if empty",
+			EnvVar: "RETENTION_AUDIT_LOG",
+		},
+		cli.DurationFlag{
+			Name:   flagRetentionEvery,
+			Usage:  "how often retention runs",
+			Value:  10 * time.Minute,
+			EnvVar: "RETENTION_INTERVAL",
+		},
+		cli.Float64Flag{
+			Name: flagDiskSoft,
+			Usage: "used percent of base dir disk, counting files of other programs, to delete oldest rotated " +
+				"log files at until usage is below it, 0 never deletes",
+			EnvVar: "DISK_SOFT_WATERMARK",
+		},
+		cli.Float64Flag{
+			Name:   flagDiskHard,
+			Usage:  "used percent of base dir disk to reject new clients and hold writes at, 0 disables disk monitor",
+			EnvVar: "DISK_HARD_WATERMARK",
+		},
+		cli.DurationFlag{
+			Name:   flagDiskInterval,
+			Usage:  "how often disk usage is checked",
+			Value:  10 * time.Second,
+			EnvVar: "DISK_CHECK_INTERVAL",
+		},
+		cli.StringFlag{
+			Name: flagSync,
+			Usage: "when log files are fsynced: none, interval, bytes or ack (before acknowledging clients), " +
+				"overrides default of stream config",
+			EnvVar: "SYNC",
+		},
+		cli.DurationFlag{
+			Name:   flagSyncInterval,
+			Usage:  "max delay of fsync after a write in interval and ack modes, default 1s",
+			EnvVar: "SYNC_INTERVAL",
+		},
+		cli.Uint64Flag{
+			Name:   flagSyncBytes,
+			Usage:  "bytes written between fsyncs in bytes mode, default 1MB",
+			EnvVar: "SYNC_BYTES",
+		},
+		cli.IntFlag{
+			Name:   flagWriteBuffer,
+			Usage:  "buffer up to this many KB per log file in memory, 0 writes each chunk directly",
+			EnvVar: "WRITE_BUFFER",
+		},
+		cli.DurationFlag{
+			Name:   flagFlushInterval,
+			Usage:  "how often buffered data is written to log files",
+			Value:  100 * time.Millisecond,
+			EnvVar: "FLUSH_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   flagWriterIdle,
+			Usage:  "close log files not written for this long and not used by any connection, 0 keeps them open",
+			EnvVar: "WRITER_IDLE_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   flagMaxOpenFiles,
+			Usage:  "max open log files, least recently used ones not used by any connection are closed, 0 is unlimited",
+			EnvVar: "MAX_OPEN_FILES",
+		},
 	)
 
 	if err := app.Run(os.Args); err != nil {
@@ -65,8 +294,190 @@ func run(c *cli.Context) error {
 	if maxSize == 0 {
 		sugar.Fatalw("max size should > 0")
 	}
-	wm := server.NewWriterMan(c.String(flagBaseDir), maxSize*1024*1024)
-	server := server.NewServer(c.String(flagBindAddr), wm)
-	sugar.Infow("server now start", "bind_addr", c.String(flagBindAddr))
-	return server.Start()
+	opts := []server.Option{server.WithMaxLineLength(c.Int(flagMaxLineLength))}
+	if c.String(flagTLSCert) != "" {
+		tlsConfig, err := common.NewServerTLSConfig(c.String(flagTLSCert), c.String(flagTLSKey),
+			c.String(flagTLSClientCA))
+		if err != nil {
+			return err
+		}
+		if c.Bool(flagTLSRestrictNames) && c.String(flagTLSClientCA) == "" {
+			sugar.Fatalw("restrict names requires client certificate verification")
+		}
+		opts = append(opts, server.WithTLS(tlsConfig, c.Bool(flagTLSRestrictNames)))
+	}
+	if c.String(flagACLFile) != "" {
+		acl, err := server.LoadACL(c.String(flagACLFile))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.WithACL(acl))
+	}
+	streamConfig := &server.StreamConfig{}
+	if c.String(flagStreamConfig) != "" {
+		if streamConfig, err = server.LoadStreamConfig(c.String(flagStreamConfig)); err != nil {
+			return err
+		}
+	}
+	if c.String(flagEnrich) != "" {
+		streamConfig.Default.Enrich = server.EnrichMode(c.String(flagEnrich))
+	}
+	setRotationFlags(c, &streamConfig.Default.Rotation)
+	if v := c.String(flagSync); v != "" {
+		streamConfig.Default.Sync.Mode = server.SyncMode(v)
+	}
+	if v := c.Duration(flagSyncInterval); v != 0 {
+		streamConfig.Default.Sync.Interval = server.Duration(v)
+	}
+	if v := c.Uint64(flagSyncBytes); v > 0 {
+		streamConfig.Default.Sync.Bytes = v
+	}
+	if v := c.Duration(flagRetentionMaxAge); v != 0 {
+		streamConfig.Default.Retention.MaxAge = server.Duration(v)
+	}
+	if v := c.Uint64(flagRetentionBytes); v > 0 {
+		streamConfig.Default.Retention.MaxBytes = v * 1024 * 1024
+	}
+	if err = streamConfig.Default.Validate(); err != nil {
+		return err
+	}
+	opts = append(opts, server.WithStreamConfig(streamConfig))
+	layout, err := server.NewLayout(c.String(flagFileTemplate), c.String(flagBackupTemplate))
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(c.String(flagTimeZone))
+	if err != nil {
+		return err
+	}
+	wmOpts := []server.WriterManOption{
+		server.WithLayout(layout),
+		server.WithLocation(loc),
+		server.WithRotation(func(name string) server.RotationPolicy {
+			return streamConfig.Settings(name).Rotation
+		}),
+		server.WithSync(func(name string) server.SyncPolicy {
+			return streamConfig.Settings(name).Sync
+		}),
+		server.WithIdleTimeout(c.Duration(flagWriterIdle)),
+		server.WithMaxOpenFiles(c.Int(flagMaxOpenFiles)),
+	}
+	if size := c.Int(flagWriteBuffer); size > 0 {
+		wmOpts = append(wmOpts, server.WithBuffer(size*1024, c.Duration(flagFlushInterval)))
+	}
+	if algo := c.String(flagCompress); algo != "" && algo != server.CompressNone {
+		compressor, err := server.NewCompressor(algo, c.Int(flagCompressLevel), c.Int(flagCompressWorkers))
+		if err != nil {
+			return err
+		}
+		wmOpts = append(wmOpts, server.WithCompressor(compressor))
+	}
+	wm := server.NewWriterMan(c.String(flagBaseDir), maxSize*1024*1024, wmOpts...)
+	retention, err := startRetention(c, wm, streamConfig)
+	if err != nil {
+		return err
+	}
+	if soft, hard := c.Float64(flagDiskSoft), c.Float64(flagDiskHard); soft > 0 || hard > 0 {
+		disk, err := server.NewDiskMonitor(c.String(flagBaseDir), soft, hard, retention)
+		if err != nil {
+			return err
+		}
+		if c.Duration(flagDiskInterval) <= 0 {
+			return fmt.Errorf("disk check interval must be positive")
+		}
+		if err = os.MkdirAll(c.String(flagBaseDir), 0755); err != nil {
+			return err
+		}
+		if err = disk.Check(time.Now()); err != nil {
+			return err
+		}
+		disk.Start(c.Duration(flagDiskInterval))
+		opts = append(opts, server.WithDiskMonitor(disk))
+	}
+	srv := server.NewServer(c.String(flagBindAddr), wm, opts...)
+	if addr := c.String(flagAdminAddr); addr != "" {
+		go func() {
+			sugar.Infow("admin api start", "addr", addr)
+			if err := http.ListenAndServe(addr, server.NewAdminHandler(srv)); err != nil {
+				sugar.Errorw("admin api stopped", "err", err)
+			}
+		}()
+	}
+	// on SIGTERM stop accepting clients and write buffered data before exit
+	stopped := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		sugar.Infow("server stopping", "signal", sig.String())
+		close(stopped)
+		_ = srv.Shutdown()
+	}()
+	sugar.Infow("server now start", "bind_addr", c.String(flagBindAddr), "tls", c.String(flagTLSCert) != "",
+		"acl", c.String(flagACLFile) != "")
+	err = srv.Start()
+	select {
+	case <-stopped:
+		err = nil
+	default:
+	}
+	// handlers must return before their writers are closed
+	_ = srv.Shutdown()
+	if cerr := wm.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("close log files failed, %w", cerr)
+	}
+	return err
+}
+
+// setRotationFlags overrides rotation policy by flags which are set.
+func setRotationFlags(c *cli.Context, p *server.RotationPolicy) {
+	if v := c.String(flagRotateSchedule); v != "" {
+		p.Schedule = v
+	}
+	if v := c.Uint64(flagRotateMaxLines); v > 0 {
+		p.MaxLines = v
+	}
+	if v := c.Duration(flagRotateMaxAge); v != 0 {
+		p.MaxAge = server.Duration(v)
+	}
+	if v := c.Duration(flagRotateIdle); v != 0 {
+		p.Idle = server.Duration(v)
+	}
+}
+
+// startRetention runs retention in background if any limit is set, the returned retention also
+// frees space when disk is low.
+func startRetention(c *cli.Context, wm *server.WriterMan, streamConfig *server.StreamConfig) (*server.Retention, error) {
+	audit := io.Writer(os.Stdout)
+	if file := c.String(flagRetentionAudit); file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		audit = f
+	}
+	opts := []server.RetentionOption{
+		server.WithRetentionPolicy(func(name string) server.RetentionPolicy {
+			return streamConfig.Settings(name).Retention
+		}),
+		server.WithMaxTotalBytes(c.Uint64(flagRetentionTotal) * 1024 * 1024),
+		server.WithAuditLog(audit),
+	}
+	if c.Bool(flagRetentionDryRun) {
+		opts = append(opts, server.WithDryRun())
+	}
+	retention := server.NewRetention(wm, opts...)
+	hasPolicy := streamConfig.Default.Retention != server.RetentionPolicy{}
+	for _, r := range streamConfig.Streams {
+		hasPolicy = hasPolicy || r.Retention != server.RetentionPolicy{}
+	}
+	if !hasPolicy && c.Uint64(flagRetentionTotal) == 0 {
+		return retention, nil
+	}
+	if c.Duration(flagRetentionEvery) <= 0 {
+		return nil, fmt.Errorf("retention interval must be positive")
+	}
+	retention.Start(c.Duration(flagRetentionEvery))
+	sugar.Infow("retention start", "interval", c.Duration(flagRetentionEvery), "dry_run", c.Bool(flagRetentionDryRun))
+	return retention, nil
 }
@@ -5,6 +5,8 @@ go 1.15
 require (
 	github.com/TheZeroSlave/zapsentry v1.5.0
 	github.com/getsentry/sentry-go v0.7.0
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.15.15
 	github.com/pierrec/lz4/v3 v3.3.5
 	github.com/pkg/errors v0.8.1
 	github.com/robfig/cron/v3 v3.0.0
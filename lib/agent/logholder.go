@@ -3,6 +3,8 @@ package agent
 import (
 	"bytes"
 	"sync"
+
+	"github.com/KyberNetwork/cclog/lib/common"
 )
 
 var (
@@ -12,23 +14,157 @@ var (
 	}}
 )
 
+// OverflowPolicy decides what LogHolder does with a write when it is full.
+type OverflowPolicy int
+
+const (
+	// PolicyBlock blocks writer until there is room in buffer.
+	PolicyBlock OverflowPolicy = iota
+	// PolicyDropNewest drops the incoming write.
+	PolicyDropNewest
+	// PolicyDropOldest drops oldest lines in buffer to make room for the incoming write.
+	PolicyDropOldest
+	// PolicySample keeps one of every sampleRate writes once buffer is half full,
+	// and drops writes which don't fit.
+	PolicySample
+)
+
+const (
+	defaultSampleRate = 10
+)
+
+// DropStats counts data dropped due to overflow.
+type DropStats struct {
+	Bytes uint64
+	Lines uint64
+}
+
+// Add counts d as dropped.
+func (s *DropStats) Add(d []byte) {
+	s.Bytes += uint64(len(d))
+	s.Lines += uint64(bytes.Count(d, []byte{'\n'}))
+}
+
 type LogHolder struct {
-	buffer *bytes.Buffer
-	lock   sync.Mutex
+	buffer     *bytes.Buffer
+	lock       sync.Mutex
+	cond       *sync.Cond
+	maxSize    int
+	policy     OverflowPolicy
+	sampleRate int
+	sampleSeq  int
+	dropped    DropStats
+	closed     bool
+	// records means buffer holds encoded common.Record, data is dropped at record boundary.
+	records bool
 }
 
+// NewLogHolder returns a holder without size limit.
 func NewLogHolder() *LogHolder {
-	return &LogHolder{
-		buffer: BufferPool.Get().(*bytes.Buffer),
+	return NewBoundedLogHolder(0, PolicyBlock, 0)
+}
+
+// NewBoundedLogHolder returns a holder which keeps at most maxSize bytes, when it is full
+// writes are handled by policy. maxSize 0 means no limit.
+func NewBoundedLogHolder(maxSize int, policy OverflowPolicy, sampleRate int) *LogHolder {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
 	}
+	h := &LogHolder{
+		buffer:     BufferPool.Get().(*bytes.Buffer),
+		maxSize:    maxSize,
+		policy:     policy,
+		sampleRate: sampleRate,
+	}
+	h.cond = sync.NewCond(&h.lock)
+	return h
+}
+
+// NewBoundedRecordHolder returns a bounded holder of encoded records, each write must be
+// whole records and only whole records are dropped.
+func NewBoundedRecordHolder(maxSize int, policy OverflowPolicy, sampleRate int) *LogHolder {
+	h := NewBoundedLogHolder(maxSize, policy, sampleRate)
+	h.records = true
+	return h
 }
 
 func (b *LogHolder) Write(d []byte) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if b.closed {
+		b.dropped.Add(d)
+		return
+	}
+	if b.maxSize <= 0 || (b.buffer.Len()+len(d) <= b.maxSize && b.policy != PolicySample) {
+		b.buffer.Write(d)
+		return
+	}
+	switch b.policy {
+	case PolicyBlock:
+		// a write larger than maxSize is accepted once buffer is empty
+		for b.buffer.Len() > 0 && b.buffer.Len()+len(d) > b.maxSize && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			b.dropped.Add(d)
+			return
+		}
+	case PolicyDropNewest:
+		b.dropped.Add(d)
+		return
+	case PolicyDropOldest:
+		b.dropOldest(b.buffer.Len() + len(d) - b.maxSize)
+		if len(d) > b.maxSize && b.records {
+			b.dropped.Add(d)
+			return
+		}
+		if len(d) > b.maxSize {
+			b.dropped.Add(d[:len(d)-b.maxSize])
+			d = d[len(d)-b.maxSize:]
+		}
+	case PolicySample:
+		sampled := true
+		if b.buffer.Len() >= b.maxSize/2 {
+			b.sampleSeq++
+			sampled = b.sampleSeq%b.sampleRate == 0
+		}
+		if !sampled || b.buffer.Len()+len(d) > b.maxSize {
+			b.dropped.Add(d)
+			return
+		}
+	}
 	b.buffer.Write(d)
 }
 
+// dropOldest drops at least n bytes from head of buffer, it cuts at line boundary when possible,
+// or record boundary if buffer holds records.
+// have to call from func that keep lock object
+func (b *LogHolder) dropOldest(n int) {
+	data := b.buffer.Bytes()
+	if n >= len(data) {
+		b.dropped.Add(data)
+		b.buffer.Reset()
+		return
+	}
+	if b.records {
+		end := 0
+		for end < n {
+			size, err := common.RecordSize(data[end:])
+			if err != nil {
+				end = len(data)
+				break
+			}
+			end += size
+		}
+		b.dropped.Add(b.buffer.Next(end))
+		return
+	}
+	if i := bytes.IndexByte(data[n:], '\n'); i >= 0 {
+		n += i + 1
+	}
+	b.dropped.Add(b.buffer.Next(n))
+}
+
 func (b *LogHolder) GetAndClear() (*bytes.Buffer, bool) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -37,5 +173,21 @@ func (b *LogHolder) GetAndClear() (*bytes.Buffer, bool) {
 	}
 	resp := b.buffer
 	b.buffer = BufferPool.Get().(*bytes.Buffer)
+	b.cond.Broadcast()
 	return resp, true
 }
+
+// Dropped returns stats of data dropped due to overflow.
+func (b *LogHolder) Dropped() DropStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+// Close releases blocked writers, writes after Close are dropped.
+func (b *LogHolder) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+func TestLogHolderDropNewest(t *testing.T) {
+	h := NewBoundedLogHolder(10, PolicyDropNewest, 0)
+	h.Write([]byte("line 1\n"))
+	h.Write([]byte("line 2\n"))
+	require.Equal(t, DropStats{Bytes: 7, Lines: 1}, h.Dropped())
+	b, ok := h.GetAndClear()
+	require.True(t, ok)
+	require.Equal(t, "line 1\n", b.String())
+}
+
+func TestLogHolderDropOldest(t *testing.T) {
+	h := NewBoundedLogHolder(16, PolicyDropOldest, 0)
+	h.Write([]byte("line 1\n"))
+	h.Write([]byte("line 2\n"))
+	h.Write([]byte("line 3\n"))
+	require.Equal(t, DropStats{Bytes: 7, Lines: 1}, h.Dropped())
+	b, ok := h.GetAndClear()
+	require.True(t, ok)
+	require.Equal(t, "line 2\nline 3\n", b.String())
+}
+
+func TestRecordHolderDropOldest(t *testing.T) {
+	rec := func(data string) []byte {
+		b, err := common.AppendRecord(nil, common.Record{Data: []byte(data)})
+		require.NoError(t, err)
+		return b
+	}
+	r1, r2, r3 := rec("a\nb"), rec("c\nd"), rec("e\nf")
+	h := NewBoundedRecordHolder(len(r1)*2+2, PolicyDropOldest, 0)
+	h.Write(r1)
+	h.Write(r2)
+	h.Write(r3)
+	// a whole record is dropped even if buffer only overflows by a few bytes
+	require.Equal(t, uint64(len(r1)), h.Dropped().Bytes)
+	b, ok := h.GetAndClear()
+	require.True(t, ok)
+	require.Equal(t, append(r2, r3...), b.Bytes())
+}
+
+func TestLogHolderSample(t *testing.T) {
+	h := NewBoundedLogHolder(100, PolicySample, 2)
+	for i := 0; i < 20; i++ {
+		h.Write([]byte("line 0\n"))
+	}
+	// 8 writes fill half of buffer, then one of every 2 writes is kept
+	require.Equal(t, uint64(6), h.Dropped().Lines)
+	b, ok := h.GetAndClear()
+	require.True(t, ok)
+	require.Equal(t, 14*7, b.Len())
+}
+
+func TestLogHolderBlock(t *testing.T) {
+	h := NewBoundedLogHolder(10, PolicyBlock, 0)
+	h.Write([]byte("line 1\n"))
+	done := make(chan struct{})
+	go func() {
+		h.Write([]byte("line 2\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("write should block while buffer is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, ok := h.GetAndClear()
+	require.True(t, ok)
+	<-done
+	require.Equal(t, DropStats{}, h.Dropped())
+}
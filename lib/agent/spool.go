@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentSize = 16 << 20
+	spoolExt         = ".spool"
+	spoolRecordHead  = 4
+)
+
+// errCorruptRecord is returned when a record doesn't fit in its segment, like when the tail of
+// the segment was truncated by a crash.
+var errCorruptRecord = errors.New("corrupt spool record")
+
+type spoolSegment struct {
+	id    uint64
+	size  int64
+	lines uint64
+}
+
+// Spool stores batches in segment files on disk, batches are read back in the order they
+// were appended. When total size exceeds maxSize, oldest segments are evicted.
+type Spool struct {
+	lock     sync.Mutex
+	dir      string
+	maxSize  int64
+	segments []spoolSegment
+	size     int64
+	writer   *os.File
+	reader   *os.File
+	readPos  int64
+	peeked   int64
+	segSize  int64
+	// dropped counts data of corrupt segments which couldn't be read back.
+	dropped DropStats
+}
+
+// NewSpool opens a spool in dir, segments left from previous run are kept to be read.
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("spool max size must be positive")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:     dir,
+		maxSize: maxSize,
+		segSize: spoolSegmentSize,
+	}
+	if s.segSize > maxSize/4 {
+		s.segSize = maxSize / 4
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{id: id, size: f.Size()})
+		s.size += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].id < s.segments[j].id
+	})
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolExt))
+}
+
+// Append writes data as a record to the last segment, it returns stats of data evicted
+// to keep spool under maxSize. Lines are not counted for segments left from previous run.
+func (s *Spool) Append(data []byte) (DropStats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.segSize {
+		if err := s.newSegment(); err != nil {
+			return DropStats{}, err
+		}
+	}
+	var head [spoolRecordHead]byte
+	binary.LittleEndian.PutUint32(head[:], uint32(len(data)))
+	n, err := s.writer.Write(append(head[:], data...))
+	last := &s.segments[len(s.segments)-1]
+	if err != nil {
+		// caller keeps data which failed to be spooled, so partial record is removed to not read
+		// it back. If it can't be removed it is read as corrupt, its size is counted then.
+		if n > 0 && s.writer.Truncate(last.size) != nil {
+			last.size += int64(n)
+			s.size += int64(n)
+		}
+		// start a new segment for next record
+		_ = s.writer.Close()
+		s.writer = nil
+		return DropStats{}, err
+	}
+	last.size += int64(n)
+	last.lines += uint64(bytes.Count(data, []byte{'\n'}))
+	s.size += int64(n)
+	return s.evict(), nil
+}
+
+// have to call from func that keep lock object
+func (s *Spool) newSegment() error {
+	if s.writer != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	var id uint64
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = f
+	s.segments = append(s.segments, spoolSegment{id: id})
+	return nil
+}
+
+// have to call from func that keep lock object
+func (s *Spool) evict() DropStats {
+	var evicted DropStats
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		seg := s.segments[0]
+		evicted.Lines += seg.lines
+		if s.reader != nil {
+			evicted.Bytes += uint64(seg.size - s.readPos)
+			s.closeReader()
+		} else {
+			evicted.Bytes += uint64(seg.size)
+		}
+		_ = os.Remove(s.segmentPath(seg.id))
+		s.size -= seg.size
+		s.segments = s.segments[1:]
+	}
+	return evicted
+}
+
+// have to call from func that keep lock object
+func (s *Spool) closeReader() {
+	if s.reader != nil {
+		_ = s.reader.Close()
+	}
+	s.reader = nil
+	s.readPos = 0
+	s.peeked = 0
+}
+
+// Peek returns the oldest record without removing it, it returns io.EOF if spool is empty.
+// A segment is only removed when it is fully read or corrupt, its unread data is counted as
+// dropped then; other read errors are returned and the record can be peeked again.
+func (s *Spool) Peek() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(seg.id))
+			if os.IsNotExist(err) {
+				s.dropped.Bytes += uint64(seg.size)
+				s.removeHead()
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.reader = f
+		}
+		data, err := s.readRecord(seg.size)
+		if err == nil {
+			return data, nil
+		}
+		if err != io.EOF && err != errCorruptRecord {
+			return nil, err
+		}
+		if s.writer != nil && len(s.segments) == 1 {
+			return nil, io.EOF
+		}
+		if err == errCorruptRecord {
+			s.dropped.Bytes += uint64(seg.size - s.readPos)
+		}
+		s.removeHead()
+	}
+	return nil, io.EOF
+}
+
+// readRecord reads record at readPos, it returns io.EOF if segment is fully read and
+// errCorruptRecord if the record is cut off. Have to call with lock held.
+func (s *Spool) readRecord(segSize int64) ([]byte, error) {
+	if s.readPos >= segSize {
+		return nil, io.EOF
+	}
+	if s.readPos+spoolRecordHead > segSize {
+		return nil, errCorruptRecord
+	}
+	var head [spoolRecordHead]byte
+	if _, err := s.reader.ReadAt(head[:], s.readPos); err != nil {
+		return nil, corruptIfShort(err)
+	}
+	length := int64(binary.LittleEndian.Uint32(head[:]))
+	if s.readPos+spoolRecordHead+length > segSize {
+		return nil, errCorruptRecord
+	}
+	data := make([]byte, length)
+	if _, err := s.reader.ReadAt(data, s.readPos+spoolRecordHead); err != nil {
+		return nil, corruptIfShort(err)
+	}
+	s.peeked = spoolRecordHead + length
+	return data, nil
+}
+
+// corruptIfShort returns errCorruptRecord if err means the file is shorter than expected.
+func corruptIfShort(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errCorruptRecord
+	}
+	return err
+}
+
+// Pop removes the record returned by last Peek.
+func (s *Spool) Pop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.peeked == 0 || len(s.segments) == 0 {
+		return
+	}
+	s.readPos += s.peeked
+	s.peeked = 0
+	if s.readPos < s.segments[0].size {
+		return
+	}
+	if s.writer != nil && len(s.segments) == 1 {
+		// drained the segment which is being written, next Append starts a new one
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	s.removeHead()
+}
+
+// have to call from func that keep lock object
+func (s *Spool) removeHead() {
+	s.closeReader()
+	seg := s.segments[0]
+	_ = os.Remove(s.segmentPath(seg.id))
+	s.size -= seg.size
+	s.segments = s.segments[1:]
+}
+
+// Size returns total bytes on disk of the spool.
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// Dropped returns stats of data lost because spool segments were corrupt.
+func (s *Spool) Dropped() DropStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Empty reports whether there is no record left to read.
+func (s *Spool) Empty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.segments) == 0 {
+		return true
+	}
+	return len(s.segments) == 1 && s.readPos >= s.segments[0].size
+}
+
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closeReader()
+	if s.writer != nil {
+		err := s.writer.Close()
+		s.writer = nil
+		return err
+	}
+	return nil
+}
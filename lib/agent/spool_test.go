@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpoolOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 1<<20)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append([]byte(fmt.Sprintf("batch %d\n", i)))
+		require.NoError(t, err)
+	}
+	data, err := s.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "batch 0\n", string(data))
+	s.Pop()
+	require.NoError(t, s.Close())
+
+	// unread records survive a restart
+	s, err = NewSpool(dir, 1<<20)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		data, err = s.Peek()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("batch %d\n", i), string(data))
+		s.Pop()
+	}
+	_, err = s.Peek()
+	require.Equal(t, io.EOF, err)
+	require.True(t, s.Empty())
+	require.Equal(t, int64(0), s.Size())
+}
+
+func TestSpoolEvictOldest(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), 400)
+	require.NoError(t, err)
+	var evicted uint64
+	for i := 0; i < 40; i++ {
+		n, err := s.Append([]byte(fmt.Sprintf("batch %02d\n", i)))
+		require.NoError(t, err)
+		evicted += n.Lines
+	}
+	require.True(t, evicted > 0)
+	require.True(t, s.Size() <= 400)
+	data, err := s.Peek()
+	require.NoError(t, err)
+	require.NotEqual(t, "batch 00\n", string(data))
+	last := ""
+	for ; err == nil; data, err = s.Peek() {
+		last = string(data)
+		s.Pop()
+	}
+	require.Equal(t, "batch 39\n", last)
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 1<<20)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Append([]byte(fmt.Sprintf("batch %d\n", i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	// crash cut off the last record
+	require.NoError(t, os.Truncate(s.segmentPath(0), 20))
+
+	s, err = NewSpool(dir, 1<<20)
+	require.NoError(t, err)
+	data, err := s.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "batch 0\n", string(data))
+	s.Pop()
+	_, err = s.Peek()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, DropStats{Bytes: 8}, s.Dropped())
+	require.True(t, s.Empty())
+}
+
+func TestSpoolReadError(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	_, err = s.Append([]byte("batch\n"))
+	require.NoError(t, err)
+	_, err = s.Append([]byte("batch 2\n"))
+	require.NoError(t, err)
+	data, err := s.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "batch\n", string(data))
+
+	// a failed read keeps the segment
+	require.NoError(t, s.reader.Close())
+	_, err = s.Peek()
+	require.Error(t, err)
+	require.NotEqual(t, io.EOF, err)
+	s.closeReader()
+	data, err = s.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "batch\n", string(data))
+	require.Equal(t, DropStats{}, s.Dropped())
+}
+
+func TestSpoolAppendFailed(t *testing.T) {
+	_, err := NewSpool(t.TempDir(), 0)
+	require.Error(t, err)
+
+	s, err := NewSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	_, err = s.Append([]byte("batch 1\n"))
+	require.NoError(t, err)
+	size := s.Size()
+	// writes to a read only file fail
+	s.lock.Lock()
+	require.NoError(t, s.writer.Close())
+	s.writer, err = os.Open(s.segmentPath(0))
+	s.lock.Unlock()
+	require.NoError(t, err)
+	_, err = s.Append([]byte("batch 2\n"))
+	require.Error(t, err)
+	require.Equal(t, size, s.Size())
+
+	// failed record is not read back, next one goes to a new segment
+	_, err = s.Append([]byte("batch 3\n"))
+	require.NoError(t, err)
+	for _, want := range []string{"batch 1\n", "batch 3\n"} {
+		data, err := s.Peek()
+		require.NoError(t, err)
+		require.Equal(t, want, string(data))
+		s.Pop()
+	}
+	_, err = s.Peek()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, DropStats{}, s.Dropped())
+}
@@ -1,14 +1,13 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"net"
+	"sync"
 	"time"
 
 	"github.com/KyberNetwork/cclog/lib/agent"
-	"github.com/pierrec/lz4/v3"
 
 	"github.com/KyberNetwork/cclog/lib/common"
 )
@@ -16,119 +15,308 @@ import (
 type SendFailedFn = func(error)
 
 type AsyncLogClient struct {
-	remoteAddr  string
+	endpoints   *endpoints
 	closeChan   chan struct{}
 	logHolder   *agent.LogHolder
 	failedFn    SendFailedFn
 	name        string
-	compression bool
+	codec       string
+	seq         uint64
+	sessionID   string
+	pending     *pendingQueue
+	spool       *agent.Spool
+	conn        *streamConn
+	opts        Options
+	backoff     *backoff
+	statsLock   sync.Mutex
+	dropped     agent.DropStats
+	closeOnce   sync.Once
+	shutdownCtx context.Context
+	shutdownErr error
+	doneChan    chan struct{}
 }
 
 const (
-	backOffSeconds = 1.0
+	defaultCloseTimeout = 5 * time.Second
 )
 
-func NewAsyncLogClient(name string, remoteAddr string, fn SendFailedFn) *AsyncLogClient {
-	return NewAsyncLogClientWithBuffer(name, remoteAddr, fn, true)
+// NewAsyncLogClient creates a client sending log of name to server in background, remoteAddr
+// can be a comma separated list of servers to fail over.
+func NewAsyncLogClient(name string, remoteAddr string, fn SendFailedFn, opts ...Option) *AsyncLogClient {
+	return NewAsyncLogClientWithBuffer(name, remoteAddr, fn, true, opts...)
 }
 
-func NewAsyncLogClientWithBuffer(name string, remoteAddr string, fn SendFailedFn, compression bool) *AsyncLogClient {
+// NewAsyncLogClientWithBuffer creates an async client, compression enables lz4 unless a codec
+// is set by WithCodec.
+func NewAsyncLogClientWithBuffer(name string, remoteAddr string, fn SendFailedFn, compression bool,
+	opts ...Option) *AsyncLogClient {
+	o := newOptions(opts)
 	c := &AsyncLogClient{
-		name:        name,
-		remoteAddr:  remoteAddr,
-		logHolder:   agent.NewLogHolder(),
-		closeChan:   make(chan struct{}),
-		failedFn:    fn,
-		compression: compression,
+		name:      name,
+		endpoints: newEndpoints(name, remoteAddr, o),
+		logHolder: newLogHolder(o),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+		failedFn:  fn,
+		codec:     o.codecOr(defaultCodec(compression)),
+		sessionID: newSessionID(),
+		pending:   newPendingQueue(),
+		opts:      o,
+		backoff:   newBackoff(o),
+	}
+	if o.SpoolDir != "" {
+		spool, err := agent.NewSpool(o.SpoolDir, o.MaxSpoolSize)
+		if err != nil {
+			fn(fmt.Errorf("open spool failed, data is dropped while disconnected, %w", err))
+		} else {
+			c.spool = spool
+		}
 	}
 	go c.loop()
 	return c
 }
 
+func newLogHolder(o Options) *agent.LogHolder {
+	if o.Records {
+		return agent.NewBoundedRecordHolder(o.MaxBufferSize, o.OverflowPolicy, o.SampleRate)
+	}
+	return agent.NewBoundedLogHolder(o.MaxBufferSize, o.OverflowPolicy, o.SampleRate)
+}
+
+// Write buffers p to send, it is a record with current time if records are enabled.
 func (l *AsyncLogClient) Write(p []byte) (n int, err error) {
+	if l.opts.Records {
+		if err = l.WriteRecord(common.Record{Time: time.Now(), Data: p}); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
 	l.logHolder.Write(p)
 	return len(p), nil
 }
 
-func (l *AsyncLogClient) Close() error {
-	close(l.closeChan)
+// WriteRecord buffers a record with metadata to send, only its data is sent if records are
+// not enabled by WithRecords.
+func (l *AsyncLogClient) WriteRecord(r common.Record) error {
+	if !l.opts.Records {
+		l.logHolder.Write(r.Data)
+		return nil
+	}
+	data, err := appendRecords(nil, r)
+	if err != nil {
+		return err
+	}
+	l.logHolder.Write(data)
 	return nil
 }
 
-func (l *AsyncLogClient) sendBuffer(w io.Writer, data []byte) error {
-	_, err := w.Write(data)
+// Close flushes pending data and stops the client, it waits at most defaultCloseTimeout.
+func (l *AsyncLogClient) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCloseTimeout)
+	defer cancel()
+	return l.Shutdown(ctx)
+}
+
+// Shutdown stops accepting new data, sends what is held and waits for server to acknowledge it
+// until ctx is done, then closes the connection and stops the sender goroutine.
+// Data which is still spooled is kept on disk for the next run.
+func (l *AsyncLogClient) Shutdown(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.shutdownCtx = ctx
+		close(l.closeChan)
+	})
+	select {
+	case <-l.doneChan:
+		return l.shutdownErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends all data left in holder and waits for acknowledgement, it is the last thing loop does.
+func (l *AsyncLogClient) flush(ctx context.Context) error {
+	l.logHolder.Close()
+	// last chance to send, don't wait for backoff
+	l.backoff.reset()
+	if buffer, ok := l.logHolder.GetAndClear(); ok {
+		l.write(buffer.Bytes())
+		buffer.Reset()
+		agent.BufferPool.Put(buffer)
+	} else if l.pending.len() > 0 {
+		l.write(nil)
+	}
+	if l.conn != nil {
+		l.pending.wait(ctx, l.conn.done)
+		l.closeConn()
+	}
+	var err error
+	if l.spool != nil {
+		err = l.spool.Close()
+	}
+	if lost := l.pending.bytes(); lost > 0 {
+		err = fmt.Errorf("%d bytes were not acknowledged by server", lost)
+	}
+	return err
+}
+
+// Stats returns stats of data dropped by client, either due to buffer limit, pending queue
+// or spool is full, or spool is corrupt.
+func (l *AsyncLogClient) Stats() agent.DropStats {
+	holder := l.logHolder.Dropped()
+	var spool agent.DropStats
+	if l.spool != nil {
+		spool = l.spool.Dropped()
+	}
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+	return agent.DropStats{
+		Bytes: holder.Bytes + spool.Bytes + l.dropped.Bytes,
+		Lines: holder.Lines + spool.Lines + l.dropped.Lines,
+	}
+}
+
+func (l *AsyncLogClient) addDropped(s agent.DropStats) {
+	l.statsLock.Lock()
+	defer l.statsLock.Unlock()
+	l.dropped.Bytes += s.Bytes
+	l.dropped.Lines += s.Lines
+}
+
+// ActiveEndpoint returns address of the server client is connected to, or empty if disconnected.
+func (l *AsyncLogClient) ActiveEndpoint() string {
+	return l.endpoints.getActive()
+}
+
+// Acked returns sequence of the last batch that server confirmed to have written.
+func (l *AsyncLogClient) Acked() uint64 {
+	return l.pending.lastAcked()
+}
+
+// connected checks the connection and reconnects if needed, unacknowledged batches are resent
+// after reconnect. It returns false if connection is not available.
+func (l *AsyncLogClient) connected() bool {
+	if l.conn != nil {
+		select {
+		case <-l.conn.done:
+			l.closeConn()
+		default:
+			return true
+		}
+	}
+	now := time.Now()
+	if !l.backoff.ready(now) {
+		// skip due recent reconnect failed
+		return false
+	}
+	var err error
+	l.conn, err = l.endpoints.dial(l.opts, connectRequest(l.opts, l.name, l.codec, l.sessionID,
+		l.pending.lastAcked()), l.pending.ack)
 	if err != nil {
-		return err
+		l.backoff.failed(now)
+		l.failedFn(err)
+		return false
 	}
-	if lw, ok := w.(*lz4.Writer); ok {
-		return lw.Flush()
+	l.backoff.reset()
+	if err = l.conn.resume(l.pending); err != nil {
+		l.failedFn(fmt.Errorf("resume failed, %w", err))
+		l.closeConn()
+		return false
 	}
-	return nil
+	return true
 }
 
-func (l *AsyncLogClient) loop() {
-	lastConnect := time.Now().Add(-2 * time.Second)
-	var (
-		streamClient net.Conn
-		writer       io.Writer
-	)
-	write := func(data []byte) {
-		var err error
-		if streamClient == nil {
-			secs := time.Since(lastConnect).Seconds()
-			if secs < backOffSeconds {
-				// skip due recent reconnect failed, we drop data as we can't hold
-				return
-			}
-			lastConnect = time.Now()
-			streamClient, err = net.Dial("tcp", l.remoteAddr)
-			if err != nil {
-				l.failedFn(fmt.Errorf("failed to connect, %w", err))
-				return
-			}
-			err = common.WriteConnectRequest(streamClient, common.ConnectRequest{Name: l.name, Compression: l.compression})
-			if err != nil {
-				l.failedFn(fmt.Errorf("write connect request failed, %w", err))
-				return
-			}
-			resp, err := common.ReadConnectResponse(streamClient)
+// closeConn closes a broken connection, reconnect is delayed by backoff so clients which
+// lost connection at the same time don't reconnect together.
+func (l *AsyncLogClient) closeConn() {
+	_ = l.conn.Close()
+	l.conn = nil
+	l.endpoints.setActive("")
+	l.backoff.failed(time.Now())
+}
+
+// hold splits data into batches and keeps them until acknowledged, so they can be resent
+// after reconnect. It returns sequence of the first batch.
+func (l *AsyncLogClient) hold(data []byte) uint64 {
+	from := l.seq + 1
+	for _, chunk := range splitBatches(data, l.opts.Records) {
+		l.seq++
+		if dropped := l.pending.push(l.seq, chunk); dropped.Bytes > 0 {
+			l.addDropped(dropped)
+			l.failedFn(fmt.Errorf("pending buffer full, dropped %d bytes", dropped.Bytes))
+		}
+	}
+	return from
+}
+
+func (l *AsyncLogClient) write(data []byte) {
+	ok := l.connected()
+	if l.spool != nil && (!ok || !l.spool.Empty()) {
+		// keep order, new data goes after what is spooled already
+		if len(data) > 0 {
+			evicted, err := l.spool.Append(data)
 			if err != nil {
-				l.failedFn(fmt.Errorf("read failed, %w", err))
-				return
-			}
-			if !resp.Success {
-				l.failedFn(fmt.Errorf("server return error, %s", resp.Status))
-				_ = streamClient.Close()
-				streamClient = nil
-				return
-			}
-			if l.compression {
-				writer = lz4.NewWriter(streamClient)
-			} else {
-				writer = streamClient
+				l.failedFn(fmt.Errorf("spool failed, %w", err))
+				l.hold(data)
+			} else if evicted.Bytes > 0 {
+				l.addDropped(evicted)
+				l.failedFn(fmt.Errorf("spool full, evicted %d bytes", evicted.Bytes))
 			}
 		}
-		log.Println("send data", "size", len(data))
-		err = l.sendBuffer(writer, data)
+		if ok {
+			l.drainSpool()
+		}
+		return
+	}
+	from := l.hold(data)
+	if !ok {
+		// data is held in pending until next connect
+		return
+	}
+	if err := l.conn.send(l.pending, from); err != nil {
+		l.failedFn(fmt.Errorf("write failed, %w", err))
+		l.closeConn()
+	}
+}
+
+// drainSpool sends spooled batches in order while pending queue has room for them.
+func (l *AsyncLogClient) drainSpool() {
+	for l.pending.bytes() < maxPendingSize/2 {
+		data, err := l.spool.Peek()
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
+			l.failedFn(fmt.Errorf("read spool failed, %w", err))
+			return
+		}
+		from := l.hold(data)
+		l.spool.Pop()
+		if err = l.conn.send(l.pending, from); err != nil {
 			l.failedFn(fmt.Errorf("write failed, %w", err))
-			_ = streamClient.Close()
-			streamClient = nil
-			writer = nil
+			l.closeConn()
+			return
 		}
 	}
-	tick := time.NewTicker(time.Millisecond * 500)
+}
+
+func (l *AsyncLogClient) loop() {
+	tick := time.NewTicker(l.opts.FlushInterval)
 	defer tick.Stop()
 	for {
 		select {
 		case <-tick.C:
 			if buffer, ok := l.logHolder.GetAndClear(); ok {
-				write(buffer.Bytes())
+				l.write(buffer.Bytes())
 				buffer.Reset()
 				agent.BufferPool.Put(buffer)
+			} else if l.pending.len() > 0 || (l.spool != nil && !l.spool.Empty()) {
+				// nothing new, but check the connection to resend what is held
+				l.write(nil)
 			}
 		case <-l.closeChan:
-			break
+			l.shutdownErr = l.flush(l.shutdownCtx)
+			close(l.doneChan)
+			return
 		}
 	}
 }
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff schedules reconnect attempts, delay grows by multiplier after each failure up to max,
+// and is randomized by jitter so clients don't reconnect in lockstep.
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	current    time.Duration
+	next       time.Time
+}
+
+func newBackoff(o Options) *backoff {
+	return &backoff{
+		initial:    o.InitialBackoff,
+		max:        o.MaxBackoff,
+		multiplier: o.BackoffMultiplier,
+		jitter:     o.BackoffJitter,
+		current:    o.InitialBackoff,
+	}
+}
+
+// ready reports whether it is time for next attempt.
+func (b *backoff) ready(now time.Time) bool {
+	return !now.Before(b.next)
+}
+
+// failed schedules next attempt after the current delay and increases it.
+func (b *backoff) failed(now time.Time) {
+	delay := float64(b.current)
+	if b.jitter > 0 {
+		delay += delay * b.jitter * (2*rand.Float64() - 1)
+	}
+	b.next = now.Add(time.Duration(delay))
+	b.current = time.Duration(float64(b.current) * b.multiplier)
+	if b.current > b.max {
+		b.current = b.max
+	}
+}
+
+// reset is called after a successful attempt.
+func (b *backoff) reset() {
+	b.current = b.initial
+	b.next = time.Time{}
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(newOptions([]Option{WithBackoff(time.Second, 3*time.Second, 2, 0.5)}))
+	now := time.Now()
+	require.True(t, b.ready(now))
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		b.failed(now)
+		delay := b.next.Sub(now)
+		require.True(t, delay >= want/2 && delay <= want*3/2, "delay %v want %v", delay, want)
+		require.False(t, b.ready(now))
+	}
+	b.reset()
+	require.True(t, b.ready(now))
+	require.Equal(t, time.Second, b.current)
+}
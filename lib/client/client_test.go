@@ -0,0 +1,221 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+	"github.com/KyberNetwork/cclog/lib/server"
+)
+
+func startTestServer(t *testing.T, baseDir string) string {
+	return startTestServerAt(t, baseDir, "127.0.0.1:0")
+}
+
+func startTestServerAt(t *testing.T, baseDir string, addr string, opts ...server.Option) string {
+	srv := server.NewServer(addr, server.NewWriterMan(baseDir, 1<<30), opts...)
+	require.NoError(t, srv.Listen())
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+	go func() {
+		_ = srv.Serve()
+	}()
+	return srv.Addr().String()
+}
+
+func TestSyncLogClientAck(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	c := NewSyncLogClient("test", addr)
+	for i := 0; i < 3; i++ {
+		_, err := c.Write([]byte("line\n"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, c.Close())
+	require.Equal(t, uint64(3), c.Acked())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line\nline\nline\n", string(data))
+}
+
+func TestSyncLogClientCodec(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	c := NewSyncLogClient("test", addr, WithCodec(common.CodecZstd))
+	_, err := c.Write([]byte("line\n"))
+	require.NoError(t, err)
+	// each write is flushed so server acknowledges it without waiting for Close
+	require.Eventually(t, func() bool {
+		return c.Acked() == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = c.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line\nline\n", string(data))
+}
+
+func TestAsyncLogClientAck(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	c := NewAsyncLogClient("test", addr, func(err error) {
+		t.Log("send failed", err)
+	})
+	_, _ = c.Write([]byte("line\n"))
+	require.Eventually(t, func() bool {
+		return c.Acked() == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	_ = c.Close()
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line\n", string(data))
+}
+
+func TestAsyncLogClientCodec(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	for _, codec := range []string{common.CodecZstd, common.CodecGzip, common.CodecSnappy, common.CodecNone} {
+		c := NewAsyncLogClient(codec, addr, func(err error) {
+			t.Log("send failed", err)
+		}, WithCodec(codec))
+		_, _ = c.Write([]byte("line\n"))
+		require.Eventually(t, func() bool {
+			return c.Acked() == 1
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, c.Close())
+		data, err := ioutil.ReadFile(filepath.Join(baseDir, codec, codec+".log"))
+		require.NoError(t, err)
+		require.Equal(t, "line\n", string(data), codec)
+	}
+}
+
+func TestAsyncLogClientRecords(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	c := NewAsyncLogClient("test", addr, func(err error) {
+		t.Log("send failed", err)
+	}, WithRecords())
+	_, _ = c.Write([]byte("panic: boom\n\tat main.go:10"))
+	require.NoError(t, c.WriteRecord(common.Record{Time: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), Level: "info",
+		Labels: map[string]string{"env": "prod"}, Data: []byte("line\n")}))
+	require.NoError(t, c.Close())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	// Write attaches current time to a record
+	require.Regexp(t, `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z panic: boom\n\tat main.go:10\n`+
+		`2021-03-04T05:06:07.000000Z info env=prod line\n$`, string(data))
+}
+
+func TestAsyncLogClientSpool(t *testing.T) {
+	baseDir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	spoolDir := t.TempDir()
+	c := NewAsyncLogClient("test", addr, func(err error) {
+		t.Log("send failed", err)
+	}, WithSpool(spoolDir, 1<<20))
+	_, _ = c.Write([]byte("line 1\n"))
+	require.Eventually(t, func() bool {
+		return c.spool.Size() > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	_, _ = c.Write([]byte("line 2\n"))
+
+	startTestServerAt(t, baseDir, addr)
+	require.Eventually(t, func() bool {
+		return c.Acked() == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	_ = c.Close()
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line 1\nline 2\n", string(data))
+}
+
+func TestAsyncLogClientCloseFlush(t *testing.T) {
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+	c := NewAsyncLogClient("test", addr, func(err error) {
+		t.Log("send failed", err)
+	})
+	_, _ = c.Write([]byte("line\n"))
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+	require.Equal(t, uint64(1), c.Acked())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line\n", string(data))
+}
+
+func TestSyncLogClientFailover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	_ = l.Close()
+	baseDir := t.TempDir()
+	addr := startTestServer(t, baseDir)
+
+	c := NewSyncLogClient("test", deadAddr+","+addr)
+	_, err = c.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.Equal(t, addr, c.ActiveEndpoint())
+	require.NoError(t, c.Close())
+	require.Equal(t, uint64(1), c.Acked())
+}
+
+func TestSyncLogClientBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	c := NewSyncLogClient("test", addr, WithBackoff(time.Second, time.Second, 1, 0))
+	_, err = c.Write([]byte("line 1\n"))
+	require.Error(t, err)
+	// data written during backoff is held until reconnect
+	n, err := c.Write([]byte("line 2\n"))
+	require.NoError(t, err)
+	require.Equal(t, 7, n)
+
+	baseDir := t.TempDir()
+	startTestServerAt(t, baseDir, addr)
+	time.Sleep(time.Second)
+	_, err = c.Write([]byte("line 3\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.Equal(t, uint64(2), c.Acked())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line 2\nline 3\n", string(data))
+}
+
+func candidateAddrs(e *endpoints) []string {
+	var addrs []string
+	for _, ep := range e.candidates() {
+		addrs = append(addrs, ep.addr)
+	}
+	return addrs
+}
+
+func TestEndpointsSelection(t *testing.T) {
+	e := newEndpoints("test", "a:1, b:1,c:1", newOptions([]Option{WithSelection(SelectRoundRobin)}))
+	require.Equal(t, []string{"a:1", "b:1", "c:1"}, candidateAddrs(e))
+	require.Equal(t, []string{"b:1", "c:1", "a:1"}, candidateAddrs(e))
+
+	e = newEndpoints("test", "a:1,b:1,c:1", newOptions(nil))
+	e.setActive("b:1")
+	e.setActive("")
+	require.Equal(t, []string{"b:1", "c:1", "a:1"}, candidateAddrs(e))
+
+	e = newEndpoints("test", "a:1,b:1,c:1", newOptions([]Option{WithSelection(SelectSticky)}))
+	first := candidateAddrs(e)
+	require.Equal(t, first, candidateAddrs(e))
+}
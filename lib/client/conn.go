@@ -0,0 +1,242 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+const (
+	closeWriteTimeout = time.Second
+)
+
+// streamConn is a connection to log server which finished handshake.
+type streamConn struct {
+	conn   net.Conn
+	writer io.Writer
+	// encoder compresses data to conn, writer is encoder when compression is used.
+	encoder common.CodecWriter
+	framed  bool
+	// records means batches are encoded records, they are sent as FrameRecords if server
+	// accepted records, or as text otherwise.
+	records         bool
+	recordsAccepted bool
+	// writeTimeout is deadline of each write, 0 means no deadline.
+	writeTimeout time.Duration
+	// resumeFrom is the sequence server expects next for the session.
+	resumeFrom uint64
+	// done is closed when ack reader stopped, which means connection is broken.
+	done chan struct{}
+}
+
+// connectRequest builds handshake of a client which compresses data by codec.
+func connectRequest(o Options, name string, codec string, sessionID string, lastAck uint64) common.ConnectRequest {
+	caps := []string{common.CapFraming, common.CapAck, common.CapResume}
+	if o.Records {
+		caps = append(caps, common.CapRecords)
+	}
+	if codec == common.CodecNone {
+		codec = ""
+	}
+	token := o.credential(name)
+	if token != "" {
+		caps = append(caps, common.CapAuth)
+	}
+	return common.ConnectRequest{
+		Name:         name,
+		Compression:  codec == common.CodecLZ4,
+		Codec:        codec,
+		Version:      common.ProtocolVersion,
+		Capabilities: caps,
+		SessionID:    sessionID,
+		LastAck:      lastAck,
+		Token:        token,
+		Hostname:     o.Hostname,
+		InstanceID:   o.InstanceID,
+		Labels:       o.Labels,
+	}
+}
+
+// dial connects to server and does handshake, onAck is called for each ack if server accepted framing.
+func dial(o Options, ep endpoint, req common.ConnectRequest, onAck func(uint64)) (*streamConn, error) {
+	if req.Codec != "" {
+		if _, ok := common.GetCodec(req.Codec); !ok {
+			return nil, fmt.Errorf("unknown codec %s", req.Codec)
+		}
+	}
+	if err := common.ValidateLabels(req.Labels); err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: o.DialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if o.TLSConfig != nil {
+		cfg := o.TLSConfig
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = ep.host
+		}
+		conn, err = tls.DialWithDialer(d, "tcp", ep.addr, cfg)
+	} else {
+		conn, err = d.Dial("tcp", ep.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect, %w", err)
+	}
+	// handshake shares the dial timeout
+	if o.DialTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(o.DialTimeout))
+	}
+	err = common.WriteConnectRequest(conn, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("write connect request failed, %w", err)
+	}
+	resp, err := common.ReadConnectResponse(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("read failed, %w", err)
+	}
+	if !resp.Success {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server return error, %s", resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	s := &streamConn{
+		conn:         conn,
+		writer:       conn,
+		writeTimeout: o.WriteTimeout,
+		resumeFrom:   resp.ResumeFrom,
+		done:         make(chan struct{}),
+		records:      common.HasCapability(req.Capabilities, common.CapRecords),
+	}
+	// server without version only knows compression flag
+	codecName := common.CodecNone
+	if req.Compression {
+		codecName = common.CodecLZ4
+	}
+	if resp.Version > 0 {
+		s.framed = common.HasCapability(resp.Capabilities, common.CapFraming) &&
+			common.HasCapability(resp.Capabilities, common.CapAck)
+		s.recordsAccepted = s.framed && common.HasCapability(resp.Capabilities, common.CapRecords)
+		codecName = resp.Codec
+	}
+	if codecName != "" && codecName != common.CodecNone {
+		codec, ok := common.GetCodec(codecName)
+		if !ok {
+			_ = conn.Close()
+			return nil, fmt.Errorf("server chose unknown codec %s", codecName)
+		}
+		if s.encoder, err = codec.NewWriter(conn); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("create codec writer failed, %w", err)
+		}
+		s.writer = s.encoder
+	}
+	if s.framed {
+		go s.readAcks(onAck)
+	}
+	return s, nil
+}
+
+func (s *streamConn) readAcks(onAck func(uint64)) {
+	defer close(s.done)
+	for {
+		f, err := common.ReadFrame(s.conn, nil)
+		if err != nil {
+			return
+		}
+		if f.Type == common.FrameAck {
+			onAck(f.Seq)
+		}
+	}
+}
+
+// write sends data as a frame if connection is framed or raw bytes otherwise, data may stay
+// in encoder until flush.
+func (s *streamConn) write(seq uint64, data []byte) error {
+	var err error
+	if s.writeTimeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	if s.records && !s.recordsAccepted {
+		// batch which is not records, like one spooled before records were enabled, is sent as is
+		if text, err := common.RecordsToText(data); err == nil {
+			data = text
+		}
+	}
+	switch {
+	case s.recordsAccepted:
+		err = common.WriteRecordsFrame(s.writer, seq, data)
+	case s.framed:
+		err = common.WriteDataFrame(s.writer, seq, data)
+	default:
+		_, err = s.writer.Write(data)
+	}
+	return err
+}
+
+// flush sends data buffered in encoder to server.
+func (s *streamConn) flush() error {
+	if s.encoder == nil {
+		return nil
+	}
+	if s.writeTimeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	return s.encoder.Flush()
+}
+
+// send writes pending batches with sequence from onwards and flushes them, batches sent over
+// connection without framing can't be acknowledged so they are removed from queue once flushed.
+func (s *streamConn) send(q *pendingQueue, from uint64) error {
+	var last uint64
+	for _, b := range q.snapshot() {
+		if b.seq < from {
+			continue
+		}
+		if err := s.write(b.seq, b.data); err != nil {
+			return err
+		}
+		last = b.seq
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if !s.framed && last > 0 {
+		q.ack(last)
+	}
+	return nil
+}
+
+// resume drops pending batches server already has and resends the rest.
+func (s *streamConn) resume(q *pendingQueue) error {
+	if s.framed && s.resumeFrom > 0 {
+		q.ack(s.resumeFrom - 1)
+	}
+	return s.send(q, 0)
+}
+
+// Close ends the compressed stream if any then closes the connection.
+func (s *streamConn) Close() error {
+	if s.encoder != nil {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		_ = s.encoder.Close()
+	}
+	return s.conn.Close()
+}
+
+// newSessionID returns a random id which identifies client in server across reconnects.
+func newSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
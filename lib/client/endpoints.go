@@ -0,0 +1,183 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+// SelectPolicy decides which endpoint a client tries first when it connects.
+type SelectPolicy int
+
+const (
+	// SelectFailover keeps using the active endpoint, and moves to the next one when it fails.
+	SelectFailover SelectPolicy = iota
+	// SelectRoundRobin starts from the next endpoint on each connect.
+	SelectRoundRobin
+	// SelectSticky starts from the endpoint chosen by hash of stream name, so all clients
+	// of a name write to the same server when it is available.
+	SelectSticky
+)
+
+// endpoint is a server address, host is the name it was resolved from, which is used to
+// verify server certificate.
+type endpoint struct {
+	addr string
+	host string
+}
+
+// endpoints holds server addresses of a client, a host with multiple A records is expanded
+// into one endpoint per address when resolveInterval is set.
+type endpoints struct {
+	lock            sync.Mutex
+	addrs           []string
+	resolved        []endpoint
+	policy          SelectPolicy
+	name            string
+	next            int
+	active          string
+	last            string
+	resolveInterval time.Duration
+	lastResolve     time.Time
+}
+
+// parseAddrs splits a comma separated address list.
+func parseAddrs(remoteAddr string) []string {
+	var addrs []string
+	for _, a := range strings.Split(remoteAddr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+func newEndpoints(name string, remoteAddr string, o Options) *endpoints {
+	addrs := parseAddrs(remoteAddr)
+	resolved := make([]endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		resolved = append(resolved, newEndpoint(addr))
+	}
+	return &endpoints{
+		addrs:           addrs,
+		resolved:        resolved,
+		policy:          o.Selection,
+		name:            name,
+		resolveInterval: o.ResolveInterval,
+	}
+}
+
+func newEndpoint(addr string) endpoint {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return endpoint{addr: addr, host: host}
+}
+
+// have to call from func that keep lock object
+func (e *endpoints) resolve(now time.Time) {
+	if e.resolveInterval <= 0 || now.Sub(e.lastResolve) < e.resolveInterval {
+		return
+	}
+	e.lastResolve = now
+	var resolved []endpoint
+	for _, addr := range e.addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			resolved = append(resolved, newEndpoint(addr))
+			continue
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil || len(ips) == 0 {
+			// keep the name, dial will resolve it again
+			resolved = append(resolved, newEndpoint(addr))
+			continue
+		}
+		// stable order so sticky selection doesn't change with DNS answer order
+		sort.Strings(ips)
+		for _, ip := range ips {
+			resolved = append(resolved, endpoint{addr: net.JoinHostPort(ip, port), host: host})
+		}
+	}
+	e.resolved = resolved
+}
+
+// candidates returns endpoints in the order they should be tried for a connect.
+func (e *endpoints) candidates() []endpoint {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.resolve(time.Now())
+	n := len(e.resolved)
+	if n == 0 {
+		return nil
+	}
+	start := 0
+	switch e.policy {
+	case SelectFailover:
+		for i, ep := range e.resolved {
+			if ep.addr == e.last {
+				start = i
+				break
+			}
+		}
+	case SelectRoundRobin:
+		start = e.next % n
+		e.next = start + 1
+	case SelectSticky:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(e.name))
+		start = int(h.Sum32() % uint32(n))
+	}
+	res := make([]endpoint, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, e.resolved[(start+i)%n])
+	}
+	return res
+}
+
+// setActive records the endpoint client is connected to, empty addr means disconnected.
+func (e *endpoints) setActive(addr string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.active = addr
+	if addr != "" {
+		e.last = addr
+	}
+}
+
+func (e *endpoints) getActive() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.active
+}
+
+// dial tries endpoints in order until one accepts the handshake.
+func (e *endpoints) dial(o Options, req common.ConnectRequest, onAck func(uint64)) (*streamConn, error) {
+	var (
+		errs    []string
+		lastErr error
+	)
+	for _, ep := range e.candidates() {
+		s, err := dial(o, ep, req, onAck)
+		if err == nil {
+			e.setActive(ep.addr)
+			return s, nil
+		}
+		lastErr = err
+		errs = append(errs, ep.addr+": "+err.Error())
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("no endpoint configured")
+	}
+	if len(errs) == 1 {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("all endpoints failed, %s - %w", strings.Join(errs, "; "), lastErr)
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"crypto/tls"
+	"os"
+	"time"
+
+	"github.com/KyberNetwork/cclog/lib/agent"
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+const (
+	defaultMaxSpoolSize      = 1 << 30
+	defaultInitialBackoff    = time.Second
+	defaultMaxBackoff        = 30 * time.Second
+	defaultBackoffMultiplier = 2.0
+	defaultBackoffJitter     = 0.2
+	defaultFlushInterval     = 500 * time.Millisecond
+	defaultDialTimeout       = 5 * time.Second
+	defaultWriteTimeout      = 10 * time.Second
+)
+
+// Options configures log clients, use Option functions to change it.
+// Buffer and spool options only apply to AsyncLogClient.
+type Options struct {
+	// InitialBackoff is the delay before reconnect after a failure, it is multiplied by
+	// BackoffMultiplier after each consecutive failure up to MaxBackoff, and randomized
+	// by +/- BackoffJitter fraction.
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	BackoffJitter     float64
+	// FlushInterval is how often AsyncLogClient sends buffered data.
+	FlushInterval time.Duration
+	DialTimeout   time.Duration
+	// WriteTimeout is the deadline of each write to server, 0 means no deadline.
+	WriteTimeout time.Duration
+	// TLSConfig enables TLS, ServerName defaults to host of each server address.
+	TLSConfig *tls.Config
+	// Token is sent to server for authentication, or a token is signed by HMACKey for each
+	// connect if it is set.
+	Token     string
+	HMACKeyID string
+	HMACKey   []byte
+	// Selection decides which of the comma separated server addresses is tried first.
+	Selection SelectPolicy
+	// ResolveInterval enables re-resolving server host names every interval, each A record
+	// becomes an endpoint.
+	ResolveInterval time.Duration
+	// Codec is name of a codec registered in common to compress data with, empty means lz4,
+	// or none for AsyncLogClient created without compression.
+	Codec string
+	// Hostname and InstanceID are sent in handshake so server can tell clients of the same name
+	// apart, Hostname defaults to host name of the machine.
+	Hostname   string
+	InstanceID string
+	// Labels are sent in handshake, server uses them in file paths and enrichment.
+	Labels map[string]string
+	// Records sends each write as a common.Record so server keeps its boundary, multi-line
+	// entries like stack traces are never split or interleaved.
+	Records bool
+
+	// SpoolDir enables spooling batches to disk while server is unreachable.
+	SpoolDir     string
+	MaxSpoolSize int64
+	// MaxBufferSize limits data held in memory before it is sent, 0 means no limit.
+	MaxBufferSize  int
+	OverflowPolicy agent.OverflowPolicy
+	SampleRate     int
+}
+
+type Option func(*Options)
+
+func defaultOptions() Options {
+	hostname, _ := os.Hostname()
+	return Options{
+		Hostname:          hostname,
+		InitialBackoff:    defaultInitialBackoff,
+		MaxBackoff:        defaultMaxBackoff,
+		BackoffMultiplier: defaultBackoffMultiplier,
+		BackoffJitter:     defaultBackoffJitter,
+		FlushInterval:     defaultFlushInterval,
+		DialTimeout:       defaultDialTimeout,
+		WriteTimeout:      defaultWriteTimeout,
+		MaxSpoolSize:      defaultMaxSpoolSize,
+	}
+}
+
+func newOptions(opts []Option) Options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithBackoff sets reconnect backoff, jitter is a fraction in [0, 1) of delay to randomize.
+func WithBackoff(initial, max time.Duration, multiplier, jitter float64) Option {
+	return func(o *Options) {
+		o.InitialBackoff = initial
+		o.MaxBackoff = max
+		if o.MaxBackoff < initial {
+			o.MaxBackoff = initial
+		}
+		o.BackoffMultiplier = multiplier
+		if o.BackoffMultiplier < 1 {
+			o.BackoffMultiplier = 1
+		}
+		o.BackoffJitter = jitter
+	}
+}
+
+// WithFlushInterval sets how often AsyncLogClient sends buffered data.
+func WithFlushInterval(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.FlushInterval = d
+		}
+	}
+}
+
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = d
+	}
+}
+
+// WithWriteTimeout sets deadline of each write to server, 0 disables it.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.WriteTimeout = d
+	}
+}
+
+// WithTLS connects to server over TLS, use common.NewClientTLSConfig to load certificates.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *Options) {
+		o.TLSConfig = cfg
+	}
+}
+
+// WithToken authenticates client to server by a static token.
+func WithToken(token string) Option {
+	return func(o *Options) {
+		o.Token = token
+	}
+}
+
+// WithHMACKey authenticates client to server by a token signed by key for each connect.
+func WithHMACKey(keyID string, key []byte) Option {
+	return func(o *Options) {
+		o.HMACKeyID = keyID
+		o.HMACKey = key
+	}
+}
+
+// WithInstance sets host name and instance id sent to server, an empty hostname keeps the default.
+func WithInstance(hostname, instanceID string) Option {
+	return func(o *Options) {
+		if hostname != "" {
+			o.Hostname = hostname
+		}
+		o.InstanceID = instanceID
+	}
+}
+
+// WithLabels sets labels like env, region, version or pod sent to server in handshake,
+// it can be used multiple times and later values override earlier ones.
+func WithLabels(labels map[string]string) Option {
+	return func(o *Options) {
+		if o.Labels == nil {
+			o.Labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			o.Labels[k] = v
+		}
+	}
+}
+
+// WithRecords sends each write as a record instead of raw bytes, clients fall back to raw
+// data on servers which don't support records.
+func WithRecords() Option {
+	return func(o *Options) {
+		o.Records = true
+	}
+}
+
+// credential returns token to send in connect request of stream name.
+func (o Options) credential(name string) string {
+	if len(o.HMACKey) > 0 {
+		return common.NewHMACToken(o.HMACKeyID, o.HMACKey, name, time.Now())
+	}
+	return o.Token
+}
+
+// WithSelection sets how client picks an endpoint when more than one server address is given.
+func WithSelection(p SelectPolicy) Option {
+	return func(o *Options) {
+		o.Selection = p
+	}
+}
+
+// WithResolveInterval re-resolves server host names every d, so all A records are used as endpoints.
+func WithResolveInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.ResolveInterval = d
+	}
+}
+
+// WithSpool stores batches in dir while server is unreachable and sends them once it is back,
+// oldest batches are evicted when spool size exceeds maxSize.
+func WithSpool(dir string, maxSize int64) Option {
+	return func(o *Options) {
+		o.SpoolDir = dir
+		if maxSize > 0 {
+			o.MaxSpoolSize = maxSize
+		}
+	}
+}
+
+// WithBufferLimit limits data held in memory to maxSize bytes, writes that overflow it are
+// handled by policy.
+func WithBufferLimit(maxSize int, policy agent.OverflowPolicy) Option {
+	return func(o *Options) {
+		o.MaxBufferSize = maxSize
+		o.OverflowPolicy = policy
+	}
+}
+
+// WithSampleRate sets how many writes are sampled to keep one with agent.PolicySample.
+func WithSampleRate(rate int) Option {
+	return func(o *Options) {
+		o.SampleRate = rate
+	}
+}
+
+// WithCodec compresses data by codec name, see common.CodecNames for codecs available.
+func WithCodec(name string) Option {
+	return func(o *Options) {
+		o.Codec = name
+	}
+}
+
+// codecOr returns codec of options, or def if it is not set.
+func (o Options) codecOr(def string) string {
+	if o.Codec != "" {
+		return o.Codec
+	}
+	return def
+}
+
+// defaultCodec returns codec used when compression is asked without naming a codec.
+func defaultCodec(compression bool) string {
+	if compression {
+		return common.CodecLZ4
+	}
+	return common.CodecNone
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/KyberNetwork/cclog/lib/agent"
+)
+
+type pendingBatch struct {
+	seq  uint64
+	data []byte
+}
+
+const (
+	maxPendingSize = 32 << 20
+)
+
+// pendingQueue holds batches which were sent but not acknowledged by server yet.
+type pendingQueue struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	batches []pendingBatch
+	size    int
+	acked   uint64
+}
+
+func newPendingQueue() *pendingQueue {
+	q := &pendingQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// push keeps a copy of data until its seq is acknowledged, oldest batches are dropped if
+// queue exceeds maxPendingSize.
+func (q *pendingQueue) push(seq uint64, data []byte) agent.DropStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.batches = append(q.batches, pendingBatch{seq: seq, data: append([]byte(nil), data...)})
+	q.size += len(data)
+	var dropped agent.DropStats
+	for q.size > maxPendingSize && len(q.batches) > 1 {
+		dropped.Add(q.batches[0].data)
+		q.size -= len(q.batches[0].data)
+		q.batches[0].data = nil
+		q.batches = q.batches[1:]
+	}
+	return dropped
+}
+
+// snapshot returns pending batches in sequence order.
+func (q *pendingQueue) snapshot() []pendingBatch {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return append([]pendingBatch(nil), q.batches...)
+}
+
+// ack removes all batches with sequence up to seq.
+func (q *pendingQueue) ack(seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if seq > q.acked {
+		q.acked = seq
+	}
+	i := 0
+	for ; i < len(q.batches) && q.batches[i].seq <= seq; i++ {
+		q.size -= len(q.batches[i].data)
+		q.batches[i].data = nil
+	}
+	q.batches = q.batches[i:]
+	q.cond.Broadcast()
+}
+
+func (q *pendingQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.batches)
+}
+
+// bytes returns total size of pending batches.
+func (q *pendingQueue) bytes() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+func (q *pendingQueue) lastAcked() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.acked
+}
+
+// wait blocks until all pending batches are acknowledged, it returns false if ctx is done
+// or done is closed before that.
+func (q *pendingQueue) wait(ctx context.Context, done <-chan struct{}) bool {
+	stop := make(chan struct{})
+	defer close(stop)
+	expired := false
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		case <-stop:
+			return
+		}
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		expired = true
+		q.cond.Broadcast()
+	}()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.batches) > 0 {
+		if expired {
+			return false
+		}
+		q.cond.Wait()
+	}
+	return true
+}
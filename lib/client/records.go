@@ -0,0 +1,60 @@
+package client
+
+import (
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+// appendRecords encodes r to dst, data larger than common.MaxRecordData is split into records
+// with the same metadata.
+func appendRecords(dst []byte, r common.Record) ([]byte, error) {
+	data := r.Data
+	for {
+		r.Data = data
+		if len(r.Data) > common.MaxRecordData {
+			r.Data = r.Data[:common.MaxRecordData]
+		}
+		var err error
+		if dst, err = common.AppendRecord(dst, r); err != nil {
+			return dst, err
+		}
+		data = data[len(r.Data):]
+		if len(data) == 0 {
+			return dst, nil
+		}
+	}
+}
+
+// splitBatches splits data into batches which fit in a frame, batches of records only contain
+// whole records.
+func splitBatches(data []byte, records bool) [][]byte {
+	var res [][]byte
+	for len(data) > 0 {
+		n := len(data)
+		if records {
+			n = recordsPrefix(data, common.MaxFramePayload)
+		}
+		if n > common.MaxFramePayload {
+			n = common.MaxFramePayload
+		}
+		res = append(res, data[:n])
+		data = data[n:]
+	}
+	return res
+}
+
+// recordsPrefix returns length of the longest prefix of data with whole records not exceeding max,
+// or length of the first record if it is longer. Data which is not a valid record is taken whole.
+func recordsPrefix(data []byte, max int) int {
+	n := 0
+	for n < len(data) {
+		size, err := common.RecordSize(data[n:])
+		if err != nil {
+			return len(data)
+		}
+		if n > 0 && n+size > max {
+			break
+		}
+		n += size
+	}
+	return n
+}
@@ -1,76 +1,180 @@
 package client
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 
+	"github.com/KyberNetwork/cclog/lib/agent"
 	"github.com/KyberNetwork/cclog/lib/common"
 )
 
+const (
+	closeAckTimeout = 5 * time.Second
+)
+
 type SyncLogClient struct {
-	remoteAddr   string
-	streamClient net.Conn
+	endpoints    *endpoints
+	streamClient *streamConn
 	name         string
+	codec        string
 	lock         sync.Mutex
-	lastConnect  time.Time
+	opts         Options
+	backoff      *backoff
+	seq          uint64
+	sessionID    string
+	pending      *pendingQueue
+	// dropped counts data dropped because pending queue was full.
+	dropped agent.DropStats
 }
 
-func NewSyncLogClient(name string, remoteAddr string) *SyncLogClient {
-	return NewSyncLogClientWithBuffer(name, remoteAddr)
+// NewSyncLogClient creates a client sending each write of name to server, remoteAddr can be
+// a comma separated list of servers to fail over. Data is compressed by lz4 like AsyncLogClient
+// unless a codec is set by WithCodec.
+func NewSyncLogClient(name string, remoteAddr string, opts ...Option) *SyncLogClient {
+	return NewSyncLogClientWithBuffer(name, remoteAddr, opts...)
 }
-func NewSyncLogClientWithBuffer(name string, remoteAddr string) *SyncLogClient {
+func NewSyncLogClientWithBuffer(name string, remoteAddr string, opts ...Option) *SyncLogClient {
+	o := newOptions(opts)
 	c := &SyncLogClient{
-		name:        name,
-		remoteAddr:  remoteAddr,
-		lastConnect: time.Now().Add(-time.Minute),
+		name:      name,
+		codec:     o.codecOr(defaultCodec(true)),
+		endpoints: newEndpoints(name, remoteAddr, o),
+		opts:      o,
+		backoff:   newBackoff(o),
+		sessionID: newSessionID(),
+		pending:   newPendingQueue(),
 	}
 	return c
 }
 
+func (l *SyncLogClient) closeConn() {
+	_ = l.streamClient.Close()
+	l.streamClient = nil
+	l.endpoints.setActive("")
+	l.backoff.failed(time.Now())
+}
+
+// connect dials server and resends batches which were not acknowledged in previous connection.
+func (l *SyncLogClient) connect() error {
+	var err error
+	l.streamClient, err = l.endpoints.dial(l.opts, connectRequest(l.opts, l.name, l.codec, l.sessionID,
+		l.pending.lastAcked()), l.pending.ack)
+	if err != nil {
+		l.backoff.failed(time.Now())
+		return err
+	}
+	l.backoff.reset()
+	if err = l.streamClient.resume(l.pending); err != nil {
+		l.closeConn()
+		return err
+	}
+	return nil
+}
+
+// Write sends p to server and flushes the codec, once sent it is kept until acknowledged and
+// resent after reconnect if connection is broken, so caller must not retry on a full write. While
+// waiting for backoff after a failed reconnect p is only queued to be sent after reconnect.
 func (l *SyncLogClient) Write(p []byte) (n int, err error) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	if l.streamClient == nil {
-		secs := time.Since(l.lastConnect).Seconds()
-		if secs < backOffSeconds {
-			// skip due recent reconnect failed, we drop data as we can't hold
-			return
-		}
-		l.lastConnect = time.Now()
-		l.streamClient, err = net.Dial("tcp", l.remoteAddr)
-		if err != nil {
-			return 0, err
+	if l.streamClient != nil {
+		select {
+		case <-l.streamClient.done:
+			l.closeConn()
+		default:
 		}
-		err = common.WriteConnectRequest(l.streamClient, common.ConnectRequest{Name: l.name})
-		if err != nil {
-			return 0, err
+	}
+	if l.streamClient == nil {
+		if !l.backoff.ready(time.Now()) {
+			// recent reconnect failed, data is held in pending and sent after reconnect
+			if _, err = l.queue(p); err != nil {
+				return 0, err
+			}
+			return len(p), nil
 		}
-		var resp common.ConnectResponse
-		resp, err = common.ReadConnectResponse(l.streamClient)
-		if err != nil {
+		if err = l.connect(); err != nil {
 			return 0, err
 		}
-		if !resp.Success {
-			fmt.Println("server error", resp.Status)
-			_ = l.streamClient.Close()
-			l.streamClient = nil
-			return
-		}
 	}
-	n, err = l.streamClient.Write(p)
+	from, err := l.queue(p)
 	if err != nil {
-		fmt.Printf("write failed, %+v", err)
-		_ = l.streamClient.Close()
-		l.streamClient = nil
+		return 0, err
+	}
+	n = len(p)
+	if err = l.streamClient.send(l.pending, from); err != nil {
+		// data is held in pending and resent after reconnect
+		l.closeConn()
+		err = nil
 	}
 	return
 }
 
+// queue splits p into batches and pushes them to pending, it returns sequence of the first batch.
+func (l *SyncLogClient) queue(p []byte) (uint64, error) {
+	data := p
+	if l.opts.Records {
+		var err error
+		if data, err = appendRecords(nil, common.Record{Time: time.Now(), Data: p}); err != nil {
+			return 0, err
+		}
+	}
+	from := l.seq + 1
+	for _, chunk := range splitBatches(data, l.opts.Records) {
+		l.seq++
+		dropped := l.pending.push(l.seq, chunk)
+		l.dropped.Bytes += dropped.Bytes
+		l.dropped.Lines += dropped.Lines
+	}
+	return from, nil
+}
+
+// Stats returns stats of data dropped because pending queue was full while server didn't
+// acknowledge it.
+func (l *SyncLogClient) Stats() agent.DropStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.dropped
+}
+
+// ActiveEndpoint returns address of the server client is connected to, or empty if disconnected.
+func (l *SyncLogClient) ActiveEndpoint() string {
+	return l.endpoints.getActive()
+}
+
+// Acked returns sequence of the last write that server confirmed to have written.
+func (l *SyncLogClient) Acked() uint64 {
+	return l.pending.lastAcked()
+}
+
+// Close waits for server to acknowledge all written data then ends the compressed stream and
+// closes the connection, if connection is broken while waiting it reconnects once to resend the rest.
 func (l *SyncLogClient) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), closeAckTimeout)
+	defer cancel()
+	var err error
+	for attempt := 0; attempt < 2 && l.pending.len() > 0; attempt++ {
+		if l.streamClient == nil {
+			if err = l.connect(); err != nil {
+				return err
+			}
+		}
+		if l.pending.wait(ctx, l.streamClient.done) {
+			break
+		}
+		l.closeConn()
+	}
+	if l.pending.len() > 0 {
+		err = fmt.Errorf("timeout waiting for server acknowledgement, %d batches pending", l.pending.len())
+	}
 	if l.streamClient != nil {
-		return l.streamClient.Close()
+		if cErr := l.streamClient.Close(); err == nil {
+			err = cErr
+		}
+		l.streamClient = nil
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+	"github.com/KyberNetwork/cclog/lib/server"
+)
+
+// writeCert signs a certificate from template by parent, or self-signed if parent is nil,
+// and writes it with its key as PEM files into dir.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, key
+}
+
+func TestTLSRestrictNames(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "cclog"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "trading-*"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCfg, err := common.NewServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"),
+		filepath.Join(dir, "ca.crt"))
+	require.NoError(t, err)
+	addr := startTestServerAt(t, t.TempDir(), "127.0.0.1:0", server.WithTLS(serverCfg, true))
+	clientCfg, err := common.NewClientTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "client.key"), "")
+	require.NoError(t, err)
+
+	c := NewSyncLogClient("trading-a", addr, WithTLS(clientCfg))
+	_, err = c.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+	require.Equal(t, uint64(1), c.Acked())
+
+	c = NewSyncLogClient("other", addr, WithTLS(clientCfg))
+	_, err = c.Write([]byte("line\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not allowed")
+}
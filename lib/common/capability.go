@@ -0,0 +1,60 @@
+package common
+
+const (
+	// ProtocolVersion is the handshake version this package speaks. Clients which don't send
+	// a version are version 0, they only use Name and Compression of ConnectRequest.
+	ProtocolVersion = 1
+)
+
+// Capabilities announced in handshake, server replies with those it accepted.
+const (
+	// CapFraming is framed data phase, see Frame.
+	CapFraming = "framing"
+	// CapAck is acknowledgement of data frames by server, it requires CapFraming.
+	CapAck = "ack"
+	// CapResume is resuming a session after reconnect, it requires CapAck.
+	CapResume = "resume"
+	// CapRecords is sending Record batches instead of raw data, it requires CapFraming.
+	CapRecords = "records"
+	// CapAuth is announced by server when it requires a token.
+	CapAuth = "auth"
+)
+
+// HasCapability reports whether c is in caps.
+func HasCapability(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateCapabilities returns capabilities of client which server supports, in client order.
+// Capabilities which depend on one not accepted are dropped too.
+func NegotiateCapabilities(client, server []string) []string {
+	var res []string
+	for _, c := range client {
+		if HasCapability(server, c) && !HasCapability(res, c) {
+			res = append(res, c)
+		}
+	}
+	if !HasCapability(res, CapFraming) {
+		res = removeCapability(res, CapAck)
+		res = removeCapability(res, CapRecords)
+	}
+	if !HasCapability(res, CapAck) {
+		res = removeCapability(res, CapResume)
+	}
+	return res
+}
+
+func removeCapability(caps []string, c string) []string {
+	res := caps[:0]
+	for _, v := range caps {
+		if v != c {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v3"
+)
+
+// Codec names supported by default.
+const (
+	CodecNone   = "none"
+	CodecLZ4    = "lz4"
+	CodecGzip   = "gzip"
+	CodecZstd   = "zstd"
+	CodecSnappy = "snappy"
+)
+
+// CodecWriter compresses data written to it, Flush sends all data written so far so peer can
+// decode it, Close ends the stream but doesn't close the underlying writer.
+type CodecWriter interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Codec compresses data stream from client to server.
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (CodecWriter, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = make(map[string]Codec)
+)
+
+// RegisterCodec makes a codec available to clients and server by its name.
+func RegisterCodec(c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+// GetCodec returns codec registered with name.
+func GetCodec(name string) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// CodecNames returns names of all registered codecs.
+func CodecNames() []string {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(lz4Codec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(zstdCodec{})
+	RegisterCodec(snappyCodec{})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Flush() error { return nil }
+func (nopWriteCloser) Close() error { return nil }
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return CodecNone }
+func (noneCodec) NewWriter(w io.Writer) (CodecWriter, error) {
+	return nopWriteCloser{Writer: w}, nil
+}
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return CodecLZ4 }
+func (lz4Codec) NewWriter(w io.Writer) (CodecWriter, error) {
+	return lz4.NewWriter(w), nil
+}
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(lz4.NewReader(r)), nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+func (gzipCodec) NewWriter(w io.Writer) (CodecWriter, error) {
+	return gzip.NewWriter(w), nil
+}
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct{}
+
+// zstdReader releases decoder goroutines on Close.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+func (zstdCodec) Name() string { return CodecZstd }
+func (zstdCodec) NewWriter(w io.Writer) (CodecWriter, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{Decoder: d}, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return CodecSnappy }
+func (snappyCodec) NewWriter(w io.Writer) (CodecWriter, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
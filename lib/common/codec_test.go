@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// zapLines returns about size bytes of json log lines like those produced by zap production logger.
+func zapLines(size int) []byte {
+	buf := &bytes.Buffer{}
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	core := zapcore.NewCore(enc, zapcore.AddSync(buf), zapcore.DebugLevel)
+	l := zap.New(core, zap.AddCaller()).Sugar()
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; buf.Len() < size; i++ {
+		l.Infow("order updated", "order_id", 1000000+i, "pair", "ETH-USDT", "side", []string{"buy", "sell"}[i%2],
+			"price", 1800.25+float64(i%100)/100, "amount", float64(i%17)*0.5, "exchange", "binance",
+			"updated_at", ts.Add(time.Duration(i)*time.Millisecond))
+	}
+	return buf.Bytes()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := zapLines(1 << 16)
+	for _, name := range CodecNames() {
+		t.Run(name, func(t *testing.T) {
+			codec, ok := GetCodec(name)
+			require.True(t, ok)
+			var buf bytes.Buffer
+			w, err := codec.NewWriter(&buf)
+			require.NoError(t, err)
+			_, err = w.Write(data[:100])
+			require.NoError(t, err)
+			require.NoError(t, w.Flush())
+			_, err = w.Write(data[100:])
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			r, err := codec.NewReader(&buf)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, data, got)
+		})
+	}
+	_, ok := GetCodec("brotli")
+	require.False(t, ok)
+}
+
+// BenchmarkCodec compresses zap json lines in 64KB batches, each batch is flushed like clients do.
+// Each iteration uses a new writer, so it can't match data of earlier iterations. ratio metric is
+// compressed size over original size of a single pass.
+func BenchmarkCodec(b *testing.B) {
+	const batchSize = 64 << 10
+	data := zapLines(4 << 20)
+	for _, name := range CodecNames() {
+		codec, _ := GetCodec(name)
+		b.Run(name, func(b *testing.B) {
+			var out countWriter
+			if err := compressBatches(codec, &out, data, batchSize); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := compressBatches(codec, ioutil.Discard, data, batchSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(out.n)/float64(len(data)), "ratio")
+		})
+	}
+}
+
+// compressBatches compresses data to out by a new writer of codec, flushing every batchSize bytes.
+func compressBatches(codec Codec, out io.Writer, data []byte, batchSize int) error {
+	w, err := codec.NewWriter(out)
+	if err != nil {
+		return err
+	}
+	for off := 0; off < len(data); off += batchSize {
+		end := off + batchSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err = w.Write(data[off:end]); err != nil {
+			return err
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
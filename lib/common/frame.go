@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameType identifies the kind of a frame exchanged in framed data phase.
+type FrameType uint8
+
+const (
+	// FrameData carries a batch of log data from client to server.
+	FrameData FrameType = 1
+	// FrameAck is sent by server, it confirms all data frames up to Seq were handed to the writer.
+	FrameAck FrameType = 2
+	// FrameRecords carries a batch of encoded records from client to server, see Record.
+	FrameRecords FrameType = 3
+)
+
+const (
+	frameHeaderSize = 13
+	// MaxFramePayload is the max size of payload a single frame can carry.
+	MaxFramePayload = 4 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame payload too large")
+
+// Frame is the unit of framed data phase, layout on wire is
+// type(1 byte) | seq(8 bytes) | length(4 bytes) | payload, all little endian.
+type Frame struct {
+	Type    FrameType
+	Seq     uint64
+	Payload []byte
+}
+
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Payload) > MaxFramePayload {
+		return ErrFrameTooLarge
+	}
+	var header [frameHeaderSize]byte
+	header[0] = byte(f.Type)
+	binary.LittleEndian.PutUint64(header[1:9], f.Seq)
+	binary.LittleEndian.PutUint32(header[9:], uint32(len(f.Payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if len(f.Payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+func WriteDataFrame(w io.Writer, seq uint64, data []byte) error {
+	return WriteFrame(w, Frame{Type: FrameData, Seq: seq, Payload: data})
+}
+
+func WriteRecordsFrame(w io.Writer, seq uint64, records []byte) error {
+	return WriteFrame(w, Frame{Type: FrameRecords, Seq: seq, Payload: records})
+}
+
+func WriteAck(w io.Writer, seq uint64) error {
+	return WriteFrame(w, Frame{Type: FrameAck, Seq: seq})
+}
+
+// ReadFrame reads next frame from in, buf is reused for payload if it has enough capacity.
+func ReadFrame(in io.Reader, buf []byte) (Frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Type: FrameType(header[0]),
+		Seq:  binary.LittleEndian.Uint64(header[1:9]),
+	}
+	length := binary.LittleEndian.Uint32(header[9:])
+	if length > MaxFramePayload {
+		return Frame{}, fmt.Errorf("read frame with length %d - %w", length, ErrFrameTooLarge)
+	}
+	if uint32(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	f.Payload = buf[:length]
+	if _, err := io.ReadFull(in, f.Payload); err != nil {
+		return Frame{}, fmt.Errorf("read frame payload with length %d - %w", length, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,28 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, WriteDataFrame(&b, 1, []byte("hello\n")))
+	require.NoError(t, WriteAck(&b, 1))
+	f, err := ReadFrame(&b, nil)
+	require.NoError(t, err)
+	require.Equal(t, FrameData, f.Type)
+	require.Equal(t, uint64(1), f.Seq)
+	require.Equal(t, "hello\n", string(f.Payload))
+	f, err = ReadFrame(&b, nil)
+	require.NoError(t, err)
+	require.Equal(t, FrameAck, f.Type)
+	require.Equal(t, uint64(1), f.Seq)
+	require.Empty(t, f.Payload)
+
+	err = WriteDataFrame(&b, 2, make([]byte, MaxFramePayload+1))
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+}
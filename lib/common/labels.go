@@ -0,0 +1,49 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode"
+)
+
+const (
+	// MaxLabels is the max number of labels a client can declare in handshake.
+	MaxLabels           = 32
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 256
+)
+
+var labelKeyGrep = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// ValidateLabels checks labels declared by a client, keys are identifiers like env or pod and
+// values are printable strings.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels, %d > %d", len(labels), MaxLabels)
+	}
+	for k, v := range labels {
+		if len(k) > maxLabelKeyLength || !labelKeyGrep.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if len(v) > maxLabelValueLength {
+			return fmt.Errorf("value of label %s too long", k)
+		}
+		for _, c := range v {
+			if !unicode.IsPrint(c) {
+				return fmt.Errorf("value of label %s has non printable char", k)
+			}
+		}
+	}
+	return nil
+}
+
+// SortedLabelKeys returns keys of labels in order.
+func SortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
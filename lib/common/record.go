@@ -0,0 +1,181 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	recordHasTime   = 1 << 0
+	recordHasLevel  = 1 << 1
+	recordHasLabels = 1 << 2
+
+	recordLengthSize = 4
+	// MaxRecordData is the max size of data a record can carry, so the record fits in a frame
+	// with room for its metadata.
+	MaxRecordData = MaxFramePayload - 64<<10
+)
+
+var ErrInvalidRecord = errors.New("invalid record")
+
+// Record is a log entry with optional metadata, it is sent in FrameRecords frames so server
+// knows entry boundaries without relying on newlines. Layout is
+// length(4 bytes, size of the rest) | flags(1 byte) | [unix nano time(8 bytes)] |
+// [level length(1 byte) | level] | [label count(1 byte) | (key length(1 byte) | key |
+// value length(2 bytes) | value)...] | data, all little endian.
+type Record struct {
+	Time   time.Time
+	Level  string
+	Labels map[string]string
+	Data   []byte
+}
+
+// AppendRecord appends encoded r to dst, labels are encoded in key order.
+func AppendRecord(dst []byte, r Record) ([]byte, error) {
+	if len(r.Data) > MaxRecordData {
+		return dst, fmt.Errorf("record data length %d - %w", len(r.Data), ErrFrameTooLarge)
+	}
+	if len(r.Level) > math.MaxUint8 || len(r.Labels) > math.MaxUint8 {
+		return dst, fmt.Errorf("record level or label count too large - %w", ErrInvalidRecord)
+	}
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+	var flags byte
+	if !r.Time.IsZero() {
+		flags |= recordHasTime
+		var ts [8]byte
+		binary.LittleEndian.PutUint64(ts[:], uint64(r.Time.UnixNano()))
+		dst = append(dst, ts[:]...)
+	}
+	if r.Level != "" {
+		flags |= recordHasLevel
+		dst = append(dst, byte(len(r.Level)))
+		dst = append(dst, r.Level...)
+	}
+	if len(r.Labels) > 0 {
+		flags |= recordHasLabels
+		keys := SortedLabelKeys(r.Labels)
+		dst = append(dst, byte(len(keys)))
+		for _, k := range keys {
+			v := r.Labels[k]
+			if len(k) > math.MaxUint8 || len(v) > math.MaxUint16 {
+				return dst[:start], fmt.Errorf("label %s too large - %w", k, ErrInvalidRecord)
+			}
+			dst = append(dst, byte(len(k)))
+			dst = append(dst, k...)
+			dst = append(dst, byte(len(v)), byte(len(v)>>8))
+			dst = append(dst, v...)
+		}
+	}
+	dst = append(dst, r.Data...)
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start-recordLengthSize))
+	dst[start+recordLengthSize] = flags
+	return dst, nil
+}
+
+// RecordSize returns size of the encoded record at head of b.
+func RecordSize(b []byte) (int, error) {
+	if len(b) < recordLengthSize+1 {
+		return 0, ErrInvalidRecord
+	}
+	size := int(binary.LittleEndian.Uint32(b)) + recordLengthSize
+	if size > len(b) || size < recordLengthSize+1 {
+		return 0, ErrInvalidRecord
+	}
+	return size, nil
+}
+
+// ReadRecord decodes the record at head of b and returns its encoded size, Data of the record
+// refers to b.
+func ReadRecord(b []byte) (Record, int, error) {
+	size, err := RecordSize(b)
+	if err != nil {
+		return Record{}, 0, err
+	}
+	flags := b[recordLengthSize]
+	p := b[recordLengthSize+1 : size]
+	var r Record
+	if flags&recordHasTime != 0 {
+		if len(p) < 8 {
+			return Record{}, 0, ErrInvalidRecord
+		}
+		r.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(p)))
+		p = p[8:]
+	}
+	if flags&recordHasLevel != 0 {
+		var level []byte
+		if level, p, err = readShortField(p, 1); err != nil {
+			return Record{}, 0, err
+		}
+		r.Level = string(level)
+	}
+	if flags&recordHasLabels != 0 {
+		if len(p) < 1 {
+			return Record{}, 0, ErrInvalidRecord
+		}
+		count := int(p[0])
+		p = p[1:]
+		r.Labels = make(map[string]string, count)
+		for i := 0; i < count; i++ {
+			var k, v []byte
+			if k, p, err = readShortField(p, 1); err != nil {
+				return Record{}, 0, err
+			}
+			if v, p, err = readShortField(p, 2); err != nil {
+				return Record{}, 0, err
+			}
+			r.Labels[string(k)] = string(v)
+		}
+	}
+	r.Data = p
+	return r, size, nil
+}
+
+// readShortField reads a field prefixed by its length in lengthSize bytes.
+func readShortField(p []byte, lengthSize int) ([]byte, []byte, error) {
+	if len(p) < lengthSize {
+		return nil, nil, ErrInvalidRecord
+	}
+	n := int(p[0])
+	if lengthSize == 2 {
+		n = int(binary.LittleEndian.Uint16(p))
+	}
+	p = p[lengthSize:]
+	if len(p) < n {
+		return nil, nil, ErrInvalidRecord
+	}
+	return p[:n], p[n:], nil
+}
+
+// ForEachRecord calls fn with each record encoded in b.
+func ForEachRecord(b []byte, fn func(Record) error) error {
+	for len(b) > 0 {
+		r, size, err := ReadRecord(b)
+		if err != nil {
+			return err
+		}
+		if err = fn(r); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// RecordsToText returns data of records in b, each ends with a newline. It is used to send
+// records to a server which doesn't support them.
+func RecordsToText(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := ForEachRecord(b, func(r Record) error {
+		buf.Write(r.Data)
+		if len(r.Data) == 0 || r.Data[len(r.Data)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		return nil
+	})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecord(t *testing.T) {
+	ts := time.Unix(1600000000, 123)
+	records := []Record{
+		{Time: ts, Level: "error", Labels: map[string]string{"env": "prod", "pod": "a-1"},
+			Data: []byte("panic\n\tat main.go:10\n")},
+		{Data: []byte("plain")},
+		{},
+	}
+	var buf []byte
+	for _, r := range records {
+		var err error
+		buf, err = AppendRecord(buf, r)
+		require.NoError(t, err)
+	}
+	var got []Record
+	require.NoError(t, ForEachRecord(buf, func(r Record) error {
+		got = append(got, r)
+		return nil
+	}))
+	require.Len(t, got, 3)
+	require.True(t, ts.Equal(got[0].Time))
+	require.Equal(t, records[0].Level, got[0].Level)
+	require.Equal(t, records[0].Labels, got[0].Labels)
+	require.Equal(t, records[0].Data, got[0].Data)
+	require.True(t, got[1].Time.IsZero())
+	require.Nil(t, got[1].Labels)
+	require.Equal(t, "plain", string(got[1].Data))
+	require.Empty(t, got[2].Data)
+
+	text, err := RecordsToText(buf)
+	require.NoError(t, err)
+	require.Equal(t, "panic\n\tat main.go:10\nplain\n\n", string(text))
+
+	size, err := RecordSize(buf)
+	require.NoError(t, err)
+	_, _, err = ReadRecord(buf[:size-1])
+	require.Equal(t, ErrInvalidRecord, err)
+	_, err = RecordsToText([]byte("raw text\n"))
+	require.Error(t, err)
+
+	_, err = AppendRecord(nil, Record{Data: make([]byte, MaxRecordData+1)})
+	require.Error(t, err)
+}
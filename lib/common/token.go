@@ -0,0 +1,53 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hmacTokenPrefix = "hmac"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+func hmacSignature(key []byte, keyID string, ts int64, name string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(keyID + ":" + strconv.FormatInt(ts, 10) + ":" + name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewHMACToken returns a token proves the client has key of keyID, it is only valid for the stream
+// name and a short time around now. Format is hmac:<key id>:<unix time>:<hex signature>.
+func NewHMACToken(keyID string, key []byte, name string, now time.Time) string {
+	ts := now.Unix()
+	return strings.Join([]string{hmacTokenPrefix, keyID, strconv.FormatInt(ts, 10),
+		hmacSignature(key, keyID, ts, name)}, ":")
+}
+
+// ParseHMACToken splits a token created by NewHMACToken, ok is false if token is not in that format.
+func ParseHMACToken(token string) (keyID string, ts int64, signature string, ok bool) {
+	parts := strings.Split(token, ":")
+	if len(parts) != 4 || parts[0] != hmacTokenPrefix {
+		return "", 0, "", false
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, "", false
+	}
+	return parts[1], ts, parts[3], true
+}
+
+// VerifyHMACToken checks signature of a token parsed by ParseHMACToken for name.
+func VerifyHMACToken(key []byte, keyID string, ts int64, signature string, name string) error {
+	expected := hmacSignature(key, keyID, ts, name)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidToken
+	}
+	return nil
+}
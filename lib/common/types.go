@@ -10,13 +10,42 @@ import (
 )
 
 type ConnectRequest struct {
-	Name        string `json:"name"`
-	Compression bool   `json:"compression"`
+	Name string `json:"name"`
+	// Compression asks for lz4 compression, it is kept for servers which don't support version 1,
+	// clients of version 1 set it when Codec is lz4.
+	Compression bool `json:"compression"`
+	// Codec is name of the codec client compresses data with, empty means none.
+	Codec string `json:"codec,omitempty"`
+	// Version is the highest protocol version client speaks, Capabilities are features it
+	// would like to use.
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// SessionID identifies client across reconnects, LastAck is the last sequence server
+	// acknowledged to client in this session.
+	SessionID string `json:"session_id,omitempty"`
+	LastAck   uint64 `json:"last_ack,omitempty"`
+	// Token is the credential when server requires authentication, either a static token
+	// or one created by NewHMACToken.
+	Token string `json:"token,omitempty"`
+	// Hostname and InstanceID identify the client process, server can add them to each line.
+	Hostname   string `json:"hostname,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	// Labels are key/value metadata like env, region or pod, see ValidateLabels.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type ConnectResponse struct {
 	Success bool   `json:"success"`
 	Status  string `json:"status"`
+	// Version is the protocol version server chose, 0 means server doesn't support negotiation.
+	// Capabilities are those of client request server accepted to use.
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// ResumeFrom is the sequence server expects next in session, client should resend
+	// batches from there.
+	ResumeFrom uint64 `json:"resume_from,omitempty"`
+	// Codec is the codec server decodes data with, it echoes codec of the request.
+	Codec string `json:"codec,omitempty"`
 }
 
 func encodeMessage(data interface{}) ([]byte, error) {
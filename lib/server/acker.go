@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+const (
+	ackInterval     = 200 * time.Millisecond
+	ackWriteTimeout = 5 * time.Second
+)
+
+// acker periodically sends back to client the sequence of last frame written.
+type acker struct {
+	l    *zap.SugaredLogger
+	conn net.Conn
+	// sync flushes or fsyncs written frames before they are acknowledged if set.
+	sync     func() error
+	seq      uint64
+	sent     uint64
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	// failed is set once acknowledging failed and connection was closed.
+	failed bool
+}
+
+func newAcker(l *zap.SugaredLogger, conn net.Conn) *acker {
+	return &acker{
+		l:        l,
+		conn:     conn,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (a *acker) start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		tick := time.NewTicker(ackInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := a.flush(); err != nil {
+					// client must not get acks of frames which are not durable, so stop
+					// reading frames too and let it resend them after reconnect
+					a.l.Errorw("acknowledge failed, close connection", "seq", atomic.LoadUint64(&a.seq), "err", err)
+					a.failed = true
+					_ = a.conn.Close()
+					return
+				}
+			case <-a.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// update marks all frames up to seq as written.
+func (a *acker) update(seq uint64) {
+	atomic.StoreUint64(&a.seq, seq)
+}
+
+func (a *acker) flush() error {
+	seq := atomic.LoadUint64(&a.seq)
+	if seq == a.sent {
+		return nil
+	}
+	if a.sync != nil {
+		if err := a.sync(); err != nil {
+			return err
+		}
+	}
+	_ = a.conn.SetWriteDeadline(time.Now().Add(ackWriteTimeout))
+	if err := common.WriteAck(a.conn, seq); err != nil {
+		return err
+	}
+	a.sent = seq
+	return nil
+}
+
+// stop stops the ack loop and try to send the final ack.
+func (a *acker) stop() {
+	close(a.stopChan)
+	a.wg.Wait()
+	if !a.failed {
+		_ = a.flush()
+	}
+}
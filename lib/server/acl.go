@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+const (
+	// hmacMaxSkew is how far timestamp of a HMAC token can be from server time.
+	hmacMaxSkew = 5 * time.Minute
+)
+
+var (
+	errUnauthorized = errors.New("invalid or missing token")
+	errForbidden    = errors.New("name is not allowed for token")
+)
+
+// ACLEntry grants a credential access to stream names matching Names, which are glob patterns.
+// The credential is either a static Token, or a hex encoded HMACKey identified by KeyID which
+// clients use to sign tokens with common.NewHMACToken.
+type ACLEntry struct {
+	Token   string   `json:"token,omitempty"`
+	KeyID   string   `json:"key_id,omitempty"`
+	HMACKey string   `json:"hmac_key,omitempty"`
+	Names   []string `json:"names"`
+}
+
+// ACL maps credentials to stream names they can write to.
+type ACL struct {
+	Entries []ACLEntry `json:"entries"`
+	hmacKey map[string][]byte
+}
+
+// LoadACL reads an ACL from a json file, like
+// {"entries": [{"token": "secret", "names": ["trading-*"]}, {"key_id": "k1", "hmac_key": "0a1b...", "names": ["*"]}]}
+func LoadACL(file string) (*ACL, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var acl ACL
+	if err = json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("parse acl file failed, %w", err)
+	}
+	acl.hmacKey = make(map[string][]byte)
+	for i, e := range acl.Entries {
+		for _, p := range e.Names {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("entry %d has invalid name pattern %s", i, p)
+			}
+		}
+		switch {
+		case e.Token != "" && e.HMACKey == "":
+		case e.Token == "" && e.HMACKey != "" && e.KeyID != "":
+			key, err := hex.DecodeString(e.HMACKey)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d has invalid hmac key, %w", i, err)
+			}
+			// key_id is a field of ':' separated token
+			if strings.Contains(e.KeyID, ":") {
+				return nil, fmt.Errorf("entry %d has key_id %s containing ':'", i, e.KeyID)
+			}
+			if _, ok := acl.hmacKey[e.KeyID]; ok {
+				return nil, fmt.Errorf("entry %d has duplicate key_id %s", i, e.KeyID)
+			}
+			acl.hmacKey[e.KeyID] = key
+		default:
+			return nil, fmt.Errorf("entry %d should have either token, or key_id and hmac_key", i)
+		}
+	}
+	return &acl, nil
+}
+
+func (e ACLEntry) allows(name string) bool {
+	for _, p := range e.Names {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks if token can write to stream name.
+func (a *ACL) Authorize(token, name string, now time.Time) error {
+	if token == "" {
+		return errUnauthorized
+	}
+	if keyID, ts, sig, ok := common.ParseHMACToken(token); ok {
+		key, found := a.hmacKey[keyID]
+		if !found {
+			return errUnauthorized
+		}
+		skew := now.Sub(time.Unix(ts, 0))
+		if skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return errUnauthorized
+		}
+		if err := common.VerifyHMACToken(key, keyID, ts, sig, name); err != nil {
+			return errUnauthorized
+		}
+		for _, e := range a.Entries {
+			if e.KeyID == keyID && e.allows(name) {
+				return nil
+			}
+		}
+		return errForbidden
+	}
+	authenticated := false
+	for _, e := range a.Entries {
+		if e.Token == "" || subtle.ConstantTimeCompare([]byte(e.Token), []byte(token)) != 1 {
+			continue
+		}
+		authenticated = true
+		if e.allows(name) {
+			return nil
+		}
+	}
+	if !authenticated {
+		return errUnauthorized
+	}
+	return errForbidden
+}
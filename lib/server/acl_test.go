@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+func TestACLAuthorize(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	file := filepath.Join(t.TempDir(), "acl.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"entries": [
+		{"token": "secret", "names": ["trading-*"]},
+		{"key_id": "k1", "hmac_key": "`+hex.EncodeToString(key)+`", "names": ["audit"]}
+	]}`), 0600))
+	acl, err := LoadACL(file)
+	require.NoError(t, err)
+	now := time.Now()
+
+	require.NoError(t, acl.Authorize("secret", "trading-a", now))
+	require.Equal(t, errForbidden, acl.Authorize("secret", "audit", now))
+	require.Equal(t, errUnauthorized, acl.Authorize("wrong", "trading-a", now))
+	require.Equal(t, errUnauthorized, acl.Authorize("", "trading-a", now))
+
+	require.NoError(t, acl.Authorize(common.NewHMACToken("k1", key, "audit", now), "audit", now))
+	// token is signed for a name
+	require.Equal(t, errUnauthorized, acl.Authorize(common.NewHMACToken("k1", key, "audit", now), "other", now))
+	require.Equal(t, errForbidden, acl.Authorize(common.NewHMACToken("k1", key, "other", now), "other", now))
+	require.Equal(t, errUnauthorized, acl.Authorize(common.NewHMACToken("k1", key, "audit", now.Add(-time.Hour)),
+		"audit", now))
+	require.Equal(t, errUnauthorized, acl.Authorize(common.NewHMACToken("k2", key, "audit", now), "audit", now))
+}
+
+func TestLoadACLDuplicateKeyID(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"entries": [
+		{"key_id": "k1", "hmac_key": "0a1b", "names": ["audit"]},
+		{"key_id": "k1", "hmac_key": "2c3d", "names": ["*"]}
+	]}`), 0600))
+	_, err := LoadACL(file)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"entries": [
+		{"key_id": "k:1", "hmac_key": "0a1b", "names": ["audit"]}
+	]}`), 0600))
+	_, err = LoadACL(file)
+	require.Error(t, err)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+)
+
+// NewAdminHandler returns http handler of the admin API, it serves
+// GET /connections: clients connected to s, filtered by name and label=key:value query params.
+// GET /debug/vars: expvar metrics like disk usage and retention deletions.
+func NewAdminHandler(s *Server) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		labels := r.URL.Query()["label"]
+		res := make([]ConnectionInfo, 0)
+		for _, c := range s.Connections() {
+			if (name == "" || c.Name == name) && hasLabels(c.Labels, labels) {
+				res = append(res, c)
+			}
+		}
+		writeJSON(w, res)
+	})
+	return mux
+}
+
+// hasLabels checks if labels contain all filters in key:value form.
+func hasLabels(labels map[string]string, filters []string) bool {
+	for _, f := range filters {
+		k, v := f, ""
+		if i := strings.IndexByte(f, ':'); i >= 0 {
+			k, v = f[:i], f[i+1:]
+		}
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -1,12 +1,17 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"net"
+	"path"
 	"regexp"
+	"sync/atomic"
+	"time"
 
 	"github.com/KyberNetwork/cclog/lib/common"
-	"github.com/pierrec/lz4/v3"
 	"go.uber.org/zap"
 )
 
@@ -21,14 +26,17 @@ var (
 type ClientHandler struct {
 	conn net.Conn
 	l    *zap.SugaredLogger
-	wMan *WriterMan
+	srv  *Server
+	// id identifies the connection in server log and enriched lines.
+	id uint64
 }
 
-func NewClientHandler(c net.Conn, wm *WriterMan) *ClientHandler {
+func NewClientHandler(c net.Conn, s *Server) *ClientHandler {
 	return &ClientHandler{
 		conn: c,
-		wMan: wm,
+		srv:  s,
 		l:    zap.S(),
+		id:   atomic.AddUint64(&s.connSeq, 1),
 	}
 }
 
@@ -49,32 +57,188 @@ func (c *ClientHandler) Run() {
 		Success: true,
 		Status:  "OK",
 	}
-	match := nameGrep.MatchString(req.Name)
-	if !match {
-		res.Status = "name can only contain alpha char"
+	f, err := c.negotiate(req, &res)
+	if err != nil {
+		c.l.Warnw("negotiate failed", "from", c.conn.RemoteAddr().String(), "name", req.Name, "err", err)
+		res.Status = err.Error()
+		res.Success = false
+	} else if status, ok := c.accept(req); !ok {
+		res.Status = status
 		res.Success = false
 	}
+	var sess *session
+	if res.Success && f.resume && req.SessionID != "" {
+		sess = c.srv.sm.getOrCreate(req.Name, req.SessionID, req.LastAck)
+		res.ResumeFrom = sess.resumeFrom()
+	}
 	if err := common.WriteConnectResponse(c.conn, res); err != nil {
 		c.l.Errorw("sent reply failed", "err", err)
 		return
 	}
-	if !match {
+	if !res.Success {
 		return
 	}
-	remote := c.conn.RemoteAddr()
-	l := c.l.With("from", remote.String(), "name", req.Name)
-	wLog := c.wMan.GetOrCreate(req.Name)
-	buff := make([]byte, readBufferSize)
-	var r io.Reader = c.conn
-	if req.Compression {
-		r = lz4.NewReader(c.conn)
+	info := ConnectionInfo{
+		ID:          c.id,
+		Name:        req.Name,
+		RemoteAddr:  c.conn.RemoteAddr().String(),
+		Hostname:    req.Hostname,
+		InstanceID:  req.InstanceID,
+		Labels:      req.Labels,
+		Version:     res.Version,
+		Codec:       f.codec.Name(),
+		ConnectedAt: time.Now(),
+	}
+	c.srv.addConnection(info)
+	defer c.srv.removeConnection(c.id)
+	l := c.l.With("from", info.RemoteAddr, "name", req.Name, "conn_id", c.id)
+	l.Infow("client connected", "hostname", req.Hostname, "instance_id", req.InstanceID, "labels", req.Labels)
+	out := c.srv.wm.Acquire(info)
+	defer c.srv.wm.Release(out)
+	var (
+		w      io.Writer = out
+		enrich *enrichWriter
+	)
+	if mode := c.srv.streams.Settings(req.Name).Enrich; mode != "" && mode != EnrichNone {
+		enrich = newEnrichWriter(w, mode, info)
+		w = enrich
+	}
+	// writer is shared by all connections of the name, only whole lines are written to it
+	wLog := newLineWriter(w, c.srv.maxLineLength)
+	defer func() {
+		if err := wLog.Flush(); err != nil {
+			l.Errorw("write incomplete line failed", "err", err)
+		}
+		if wLog.split > 0 {
+			l.Warnw("lines exceeded max length were split", "count", wLog.split, "max_length", wLog.maxLine)
+		}
+	}()
+	r, err := f.codec.NewReader(c.conn)
+	if err != nil {
+		l.Errorw("create codec reader failed", "codec", f.codec.Name(), "err", err)
+		return
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	if f.framing {
+		var recWriter io.Writer
+		if f.records {
+			recWriter = newRecordWriter(out, enrich)
+		}
+		// acknowledged data must at least be written to file, buffered data is flushed first
+		var sync func() error
+		if out.sync.Mode == SyncAck {
+			sync = out.Sync
+		} else if out.bufferSize > 0 {
+			sync = out.Flush
+		}
+		c.readFrames(l, r, wLog, recWriter, f.ack, sync, sess)
+		return
+	}
+	c.readStream(l, r, wLog)
+}
+
+// features are what client and server agreed to use in data phase.
+type features struct {
+	framing bool
+	ack     bool
+	resume  bool
+	records bool
+	codec   common.Codec
+}
+
+// negotiate picks protocol version and capabilities both sides support and sets them in res.
+// Clients without version only know Compression flag. It fails if codec of client is unknown.
+func (c *ClientHandler) negotiate(req common.ConnectRequest, res *common.ConnectResponse) (features, error) {
+	if req.Version <= 0 {
+		name := common.CodecNone
+		if req.Compression {
+			name = common.CodecLZ4
+		}
+		codec, _ := common.GetCodec(name)
+		return features{codec: codec}, nil
+	}
+	name := req.Codec
+	if name == "" {
+		name = common.CodecNone
+	}
+	codec, ok := common.GetCodec(name)
+	if !ok {
+		return features{}, fmt.Errorf("unsupported codec %s", req.Codec)
+	}
+	res.Version = req.Version
+	if res.Version > common.ProtocolVersion {
+		res.Version = common.ProtocolVersion
+	}
+	res.Capabilities = common.NegotiateCapabilities(req.Capabilities, c.srv.capabilities())
+	res.Codec = name
+	return features{
+		framing: common.HasCapability(res.Capabilities, common.CapFraming),
+		ack:     common.HasCapability(res.Capabilities, common.CapAck),
+		resume:  common.HasCapability(res.Capabilities, common.CapResume),
+		records: common.HasCapability(res.Capabilities, common.CapRecords),
+		codec:   codec,
+	}, nil
+}
+
+// accept validates connect request, it returns status to reply when request is rejected.
+func (c *ClientHandler) accept(req common.ConnectRequest) (string, bool) {
+	if !nameGrep.MatchString(req.Name) {
+		return "name can only contain alpha char", false
+	}
+	if c.srv.disk != nil && c.srv.disk.State() == DiskFull {
+		rejectedDiskFull.Add(1)
+		c.l.Warnw("reject client, disk is full", "from", c.conn.RemoteAddr().String(), "name", req.Name)
+		return StatusDiskFull, false
+	}
+	if err := common.ValidateLabels(req.Labels); err != nil {
+		return err.Error(), false
+	}
+	if c.srv.restrictNames {
+		tc, ok := c.conn.(*tls.Conn)
+		if !ok || !certAllowsName(tc.ConnectionState().PeerCertificates, req.Name) {
+			c.l.Warnw("name is not allowed by client certificate", "from", c.conn.RemoteAddr().String(),
+				"name", req.Name)
+			return "name is not allowed by client certificate", false
+		}
+	}
+	if c.srv.acl != nil {
+		if err := c.srv.acl.Authorize(req.Token, req.Name, time.Now()); err != nil {
+			c.l.Warnw("connect denied", "from", c.conn.RemoteAddr().String(), "name", req.Name, "err", err)
+			return err.Error(), false
+		}
 	}
+	return "", true
+}
+
+// certAllowsName checks if name matches CN or one of DNS SANs of the client leaf certificate.
+func certAllowsName(certs []*x509.Certificate, name string) bool {
+	if len(certs) == 0 {
+		return false
+	}
+	leaf := certs[0]
+	patterns := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	for _, p := range patterns {
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readStream copies raw data stream to writer, used by clients without framing.
+func (c *ClientHandler) readStream(l *zap.SugaredLogger, r io.Reader, wLog io.Writer) {
+	buff := make([]byte, readBufferSize)
 	for {
 		n, err := r.Read(buff)
 		if err != nil {
 			l.Errorw("read failed", "err", err)
 			break
 		}
+		if !c.waitDisk(l) {
+			break
+		}
 		nw, err := wLog.Write(buff[:n])
 		if err != nil {
 			l.Errorw("write failed", "err", err)
@@ -86,3 +250,90 @@ func (c *ClientHandler) Run() {
 		}
 	}
 }
+
+// readFrames writes each data frame to wLog and records frame to recWriter, and acknowledges its
+// sequence to client after that if withAck is set, after calling sync if it is set. A frame
+// ending in an incomplete line held by wLog is acknowledged once the line is written. If client
+// has a session, frames which were written before are acknowledged without writing. recWriter
+// is nil if client can't send records.
+func (c *ClientHandler) readFrames(l *zap.SugaredLogger, r io.Reader, wLog *lineWriter, recWriter io.Writer,
+	withAck bool, sync func() error, sess *session) {
+	ack := newAcker(l, c.conn)
+	ack.sync = sync
+	if withAck {
+		ack.start()
+		defer ack.stop()
+	}
+	buff := make([]byte, readBufferSize)
+	for {
+		f, err := common.ReadFrame(r, buff)
+		if err != nil {
+			l.Errorw("read frame failed", "err", err)
+			break
+		}
+		if cap(f.Payload) > cap(buff) {
+			buff = f.Payload
+		}
+		var w io.Writer
+		switch {
+		case f.Type == common.FrameData:
+			w = wLog
+		case f.Type == common.FrameRecords && recWriter != nil:
+			w = recWriter
+		default:
+			l.Errorw("unexpected frame", "type", f.Type)
+			return
+		}
+		var (
+			nw  int
+			seq = f.Seq
+		)
+		if !c.waitDisk(l) {
+			break
+		}
+		if sess != nil {
+			seq, nw, err = sess.write(w, f.Seq, f.Payload)
+		} else {
+			nw, err = w.Write(f.Payload)
+		}
+		if err != nil {
+			l.Errorw("write failed", "err", err)
+			break
+		}
+		if nw != len(f.Payload) {
+			l.Errorw("short write", "nw", nw, "src_length", len(f.Payload))
+			break
+		}
+		switch tail := wLog.pending(); {
+		case tail == 0:
+			ack.update(seq)
+		case f.Type == common.FrameData && seq == f.Seq && tail <= len(f.Payload):
+			// incomplete line started in this frame, frames before it are fully written
+			ack.update(f.Seq - 1)
+		}
+	}
+}
+
+// waitDisk blocks while disk is full, client is not read meanwhile so it gets backpressure. It
+// returns false if server is shut down while waiting.
+func (c *ClientHandler) waitDisk(l *zap.SugaredLogger) bool {
+	if c.srv.disk == nil {
+		return true
+	}
+	writable := c.srv.disk.Writable()
+	select {
+	case <-writable:
+		return true
+	default:
+	}
+	l.Warnw("disk is full, waiting for space")
+	start := time.Now()
+	select {
+	case <-writable:
+	case <-c.srv.stopped:
+		l.Warnw("server stopped while waiting for disk space")
+		return false
+	}
+	l.Infow("disk has space, resume writing", "waited", time.Since(start))
+	return true
+}
@@ -1,11 +1,33 @@
 package server
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pierrec/lz4/v3"
 	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
 )
 
+func startTestServer(t *testing.T, baseDir string, opts ...Option) *Server {
+	srv := NewServer("127.0.0.1:0", NewWriterMan(baseDir, 1<<30), opts...)
+	require.NoError(t, srv.Listen())
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+	go func() {
+		_ = srv.Serve()
+	}()
+	return srv
+}
+
 func TestValidateClient(t *testing.T) {
 	require.True(t, nameGrep.MatchString("abc12"))
 	require.True(t, nameGrep.MatchString("abc12-"))
@@ -14,3 +36,122 @@ func TestValidateClient(t *testing.T) {
 	require.False(t, nameGrep.MatchString("abc12\\"))
 	require.False(t, nameGrep.MatchString("abc12."))
 }
+
+func TestLegacyClient(t *testing.T) {
+	baseDir := t.TempDir()
+	srv := startTestServer(t, baseDir)
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{Name: "test", Compression: true}))
+	resp, err := common.ReadConnectResponse(conn)
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	require.Equal(t, 0, resp.Version)
+	require.Empty(t, resp.Capabilities)
+	w := lz4.NewWriter(conn)
+	_, err = w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	file := filepath.Join(baseDir, "test", "test.log")
+	require.Eventually(t, func() bool {
+		data, _ := ioutil.ReadFile(file)
+		return string(data) == "line\n"
+	}, 5*time.Second, 50*time.Millisecond)
+	_ = conn.Close()
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	srv := startTestServer(t, t.TempDir())
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{
+		Name:         "test",
+		Version:      common.ProtocolVersion + 1,
+		Capabilities: []string{"zip", common.CapResume, common.CapFraming},
+	}))
+	resp, err := common.ReadConnectResponse(conn)
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	require.Equal(t, common.ProtocolVersion, resp.Version)
+	// resume needs ack
+	require.Equal(t, []string{common.CapFraming}, resp.Capabilities)
+	require.Equal(t, common.CodecNone, resp.Codec)
+}
+
+func TestCodec(t *testing.T) {
+	baseDir := t.TempDir()
+	srv := startTestServer(t, baseDir)
+	dial := func(codec string) (net.Conn, common.ConnectResponse) {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{
+			Name:    "test",
+			Version: common.ProtocolVersion,
+			Codec:   codec,
+		}))
+		resp, err := common.ReadConnectResponse(conn)
+		require.NoError(t, err)
+		return conn, resp
+	}
+
+	_, resp := dial("brotli")
+	require.False(t, resp.Success)
+	require.Contains(t, resp.Status, "unsupported codec")
+
+	conn, resp := dial(common.CodecZstd)
+	require.True(t, resp.Success)
+	require.Equal(t, common.CodecZstd, resp.Codec)
+	codec, _ := common.GetCodec(common.CodecZstd)
+	w, err := codec.NewWriter(conn)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	file := filepath.Join(baseDir, "test", "test.log")
+	require.Eventually(t, func() bool {
+		data, _ := ioutil.ReadFile(file)
+		return string(data) == "line\n"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestLabels(t *testing.T) {
+	srv := startTestServer(t, t.TempDir())
+	dial := func(labels map[string]string) common.ConnectResponse {
+		conn, err := net.Dial("tcp", srv.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{
+			Name:     "test",
+			Version:  common.ProtocolVersion,
+			Hostname: "web-1",
+			Labels:   labels,
+		}))
+		resp, err := common.ReadConnectResponse(conn)
+		require.NoError(t, err)
+		return resp
+	}
+	require.False(t, dial(map[string]string{"bad key": "v"}).Success)
+	require.True(t, dial(map[string]string{"env": "prod", "pod": "web-1-abc"}).Success)
+	require.True(t, dial(map[string]string{"env": "staging"}).Success)
+
+	h := NewAdminHandler(srv)
+	var conns []ConnectionInfo
+	require.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections?label=env:prod", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &conns))
+		return len(conns) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, "test", conns[0].Name)
+	require.Equal(t, "web-1", conns[0].Hostname)
+	require.Equal(t, map[string]string{"env": "prod", "pod": "web-1-abc"}, conns[0].Labels)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// Compression algorithms of rotated files.
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+
+	tmpSuffix = ".tmp"
+)
+
+// Compressor compresses rotated files in background. Compressed data is written to a temp file
+// which is renamed to the final name once complete, the original file is removed only after
+// that, so a failure or crash never loses uncompressed data.
+type Compressor struct {
+	algo  string
+	level int
+	l     *zap.SugaredLogger
+	sem   chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewCompressor returns compressor of algo gzip or zstd. Level 0 is the default level of algo,
+// at most concurrency files are compressed at the same time.
+func NewCompressor(algo string, level int, concurrency int) (*Compressor, error) {
+	switch algo {
+	case CompressGzip:
+		if level != 0 && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+			return nil, fmt.Errorf("gzip level must be from %d to %d", gzip.BestSpeed, gzip.BestCompression)
+		}
+	case CompressZstd:
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("zstd level must be from 1 to 22")
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %s", algo)
+	}
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("compress concurrency must be positive")
+	}
+	return &Compressor{
+		algo:  algo,
+		level: level,
+		l:     zap.S(),
+		sem:   make(chan struct{}, concurrency),
+	}, nil
+}
+
+// Ext returns extension appended to names of compressed files.
+func (c *Compressor) Ext() string {
+	if c.algo == CompressGzip {
+		return ".gz"
+	}
+	return ".zst"
+}
+
+// Compress compresses file in background and removes it when done.
+func (c *Compressor) Compress(file string) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.sem <- struct{}{}
+		defer func() { <-c.sem }()
+		if err := c.compress(file); err != nil {
+			c.l.Errorw("compress failed, file is kept uncompressed", "file", file, "algo", c.algo, "err", err)
+		}
+	}()
+}
+
+// Wait waits for all started compressions.
+func (c *Compressor) Wait() {
+	c.wg.Wait()
+}
+
+func (c *Compressor) compress(file string) (err error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst := file + c.Ext()
+	tmp, err := os.OpenFile(dst+tmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	enc, err := c.newWriter(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(enc, src); err != nil {
+		_ = enc.Close()
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+func (c *Compressor) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.algo == CompressGzip {
+		level := c.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if c.level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+	}
+	return zstd.NewWriter(w, opts...)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressor(t *testing.T) {
+	data := strings.Repeat("some log line\n", 1000)
+	for _, algo := range []string{CompressGzip, CompressZstd} {
+		c, err := NewCompressor(algo, 0, 1)
+		require.NoError(t, err)
+		file := filepath.Join(t.TempDir(), "app-1.log")
+		require.NoError(t, ioutil.WriteFile(file, []byte(data), 0644))
+		c.Compress(file)
+		c.Wait()
+		_, err = os.Stat(file)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(file + c.Ext() + tmpSuffix)
+		require.True(t, os.IsNotExist(err))
+
+		f, err := os.Open(file + c.Ext())
+		require.NoError(t, err)
+		var r io.Reader
+		if algo == CompressGzip {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, string(got))
+		require.NoError(t, f.Close())
+	}
+
+	_, err := NewCompressor("xz", 0, 1)
+	require.Error(t, err)
+	_, err = NewCompressor(CompressGzip, 10, 1)
+	require.Error(t, err)
+}
+
+func TestCompressorKeepsFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCompressor(CompressGzip, 0, 1)
+	require.NoError(t, err)
+	file := filepath.Join(dir, "app-1.log")
+	require.NoError(t, ioutil.WriteFile(file, []byte("line\n"), 0644))
+	// temp file can't be created
+	require.NoError(t, os.Mkdir(file+c.Ext()+tmpSuffix, 0755))
+	c.Compress(file)
+	c.Wait()
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "line\n", string(data))
+	_, err = os.Stat(file + c.Ext())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewCompressor(CompressZstd, 3, 2)
+	require.NoError(t, err)
+	w := newRotateLogWriter(RotationPolicy{MaxLines: 1}, func(time.Time) string {
+		return filepath.Join(dir, "app.log")
+	}, func(current string, _, _ time.Time) string {
+		return filepath.Join(dir, "app-range.log")
+	})
+	w.compressor = c
+	for i := 0; i < 2; i++ {
+		_, err = w.Write([]byte("line\n"))
+		require.NoError(t, err)
+		c.Wait()
+	}
+	// second backup doesn't overwrite the compressed first one
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "app-range.1.log.zst"), filepath.Join(dir, "app-range.log.zst")}, files)
+}
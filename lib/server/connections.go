@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// ConnectionInfo describes a client connection, it is what the client declared in handshake
+// plus what server knows about the connection.
+type ConnectionInfo struct {
+	ID          uint64            `json:"id"`
+	Name        string            `json:"name"`
+	RemoteAddr  string            `json:"remote_addr"`
+	Hostname    string            `json:"hostname,omitempty"`
+	InstanceID  string            `json:"instance_id,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Version     int               `json:"version"`
+	Codec       string            `json:"codec,omitempty"`
+	ConnectedAt time.Time         `json:"connected_at"`
+}
+
+func (s *Server) addConnection(info ConnectionInfo) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	s.conns[info.ID] = info
+}
+
+func (s *Server) removeConnection(id uint64) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	delete(s.conns, id)
+}
+
+// Connections returns clients connected to server in order they connected.
+func (s *Server) Connections() []ConnectionInfo {
+	s.connLock.Lock()
+	res := make([]ConnectionInfo, 0, len(s.conns))
+	for _, info := range s.conns {
+		res = append(res, info)
+	}
+	s.connLock.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DiskState is how full the file system of base dir is.
+type DiskState int32
+
+const (
+	// DiskOK is below soft watermark.
+	DiskOK DiskState = iota
+	// DiskLow is above soft watermark, retention deletes oldest rotated files to free space.
+	DiskLow
+	// DiskFull is above hard watermark, new clients are rejected and writes wait for space.
+	DiskFull
+)
+
+// StatusDiskFull is the handshake status when server rejects clients at hard watermark.
+const StatusDiskFull = "server disk is full, try again later"
+
+func (s DiskState) String() string {
+	switch s {
+	case DiskLow:
+		return "low"
+	case DiskFull:
+		return "full"
+	}
+	return "ok"
+}
+
+// DiskMonitor checks used space of the file system of base dir against watermarks in percent.
+// Above soft watermark it runs retention to delete rotated files down to the soft watermark,
+// above hard watermark server rejects handshakes and connected clients wait until space is freed.
+// Usage counts all files of the file system, not only logs.
+type DiskMonitor struct {
+	dir       string
+	soft      float64
+	hard      float64
+	retention *Retention
+	l         *zap.SugaredLogger
+	// usage returns free and total bytes of dir, replaced in tests.
+	usage func(dir string) (free, total uint64, err error)
+
+	lock  sync.Mutex
+	state DiskState
+	// writable is closed when disk is not full.
+	writable chan struct{}
+}
+
+// NewDiskMonitor returns monitor of dir, retention is used to free space and can be nil. Soft
+// watermark 0 disables freeing space.
+func NewDiskMonitor(dir string, soft, hard float64, retention *Retention) (*DiskMonitor, error) {
+	if soft < 0 || hard <= 0 || soft > hard || hard > 100 {
+		return nil, fmt.Errorf("watermarks must be 0 <= soft <= hard <= 100 and hard > 0")
+	}
+	writable := make(chan struct{})
+	close(writable)
+	return &DiskMonitor{
+		dir:       dir,
+		soft:      soft,
+		hard:      hard,
+		retention: retention,
+		l:         zap.S(),
+		usage:     diskUsage,
+		writable:  writable,
+	}, nil
+}
+
+// Start checks disk every interval in background.
+func (d *DiskMonitor) Start(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for now := range t.C {
+			if err := d.Check(now); err != nil {
+				d.l.Errorw("check disk usage failed", "dir", d.dir, "err", err)
+			}
+		}
+	}()
+}
+
+// Check updates disk state once, it runs retention first if used space is above soft watermark.
+func (d *DiskMonitor) Check(now time.Time) error {
+	free, total, err := d.usage(d.dir)
+	if err != nil {
+		return err
+	}
+	if used := usedPercent(free, total); d.soft > 0 && used >= d.soft && d.retention != nil {
+		need := uint64((used - d.soft) / 100 * float64(total))
+		res, err := d.retention.Free(need, now)
+		if err != nil {
+			d.l.Errorw("free disk space failed", "err", err)
+		}
+		var freed int64
+		for _, r := range res {
+			freed += r.Size
+		}
+		d.l.Warnw("disk usage above soft watermark, deleted oldest rotated files", "used_percent", used,
+			"soft_watermark", d.soft, "need_bytes", need, "deleted_files", len(res), "deleted_bytes", freed)
+		if free, total, err = d.usage(d.dir); err != nil {
+			return err
+		}
+	}
+	used := usedPercent(free, total)
+	diskFreeBytes.Set(int64(free))
+	diskUsedPercent.Set(used)
+	state := DiskOK
+	switch {
+	case used >= d.hard:
+		state = DiskFull
+	case d.soft > 0 && used >= d.soft:
+		state = DiskLow
+	}
+	d.setState(state, used)
+	diskStateVar.Set(state.String())
+	return nil
+}
+
+func usedPercent(free, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(total-free) / float64(total) * 100
+}
+
+func (d *DiskMonitor) setState(state DiskState, used float64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if state == d.state {
+		return
+	}
+	switch {
+	case state == DiskFull:
+		d.l.Errorw("disk usage above hard watermark, rejecting clients", "used_percent", used,
+			"hard_watermark", d.hard)
+		d.writable = make(chan struct{})
+	case d.state == DiskFull:
+		d.l.Infow("disk usage below hard watermark, accepting clients", "used_percent", used)
+		close(d.writable)
+	}
+	d.state = state
+}
+
+// State returns the last checked disk state.
+func (d *DiskMonitor) State() DiskState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.state
+}
+
+// Writable returns a channel which is closed when disk is not full.
+func (d *DiskMonitor) Writable() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.writable
+}
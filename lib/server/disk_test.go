@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"expvar"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+// dirUsage returns usage of a fake disk of 1000 bytes holding files of dir.
+func dirUsage(dir string) (free, total uint64, err error) {
+	var used uint64
+	err = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			used += uint64(info.Size())
+		}
+		return err
+	})
+	return 1000 - used, 1000, err
+}
+
+func TestDiskMonitor(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWriterMan(dir, 1<<30)
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "a/a-20210101_000000-20210101_235959.log"), 300, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(dir, "a/a-20210102_000000-20210102_235959.log"), 300, now.Add(-time.Hour))
+	w := wm.GetOrCreate("a")
+	_, err := w.Write(make([]byte, 380))
+	require.NoError(t, err)
+	defer w.Close()
+	var audit bytes.Buffer
+	d, err := NewDiskMonitor(dir, 80, 95, NewRetention(wm, WithAuditLog(&audit)))
+	require.NoError(t, err)
+	d.usage = dirUsage
+
+	// 98% used, retention deletes the oldest backup to get below soft watermark
+	require.NoError(t, d.Check(now))
+	require.Equal(t, DiskOK, d.State())
+	require.Equal(t, []string{"a/a-20210102_000000-20210102_235959.log", "a/a.log"}, listFiles(t, dir))
+	require.Contains(t, audit.String(), ReasonDiskWatermark)
+	require.Equal(t, `"ok"`, expvar.Get("cclog").(*expvar.Map).Get("disk_state").String())
+
+	// files which can't be deleted fill disk
+	require.NoError(t, os.Remove(filepath.Join(dir, "a/a-20210102_000000-20210102_235959.log")))
+	writeFile(t, filepath.Join(dir, "notes.txt"), 450, now)
+	require.NoError(t, d.Check(now))
+	require.Equal(t, DiskLow, d.State())
+	require.Equal(t, []string{"a/a.log", "notes.txt"}, listFiles(t, dir))
+	writeFile(t, filepath.Join(dir, "notes.txt"), 600, now)
+	require.NoError(t, d.Check(now))
+	require.Equal(t, DiskFull, d.State())
+	select {
+	case <-d.Writable():
+		t.Fatal("disk is full")
+	default:
+	}
+	require.NoError(t, os.Remove(filepath.Join(dir, "notes.txt")))
+	require.NoError(t, d.Check(now))
+	require.Equal(t, DiskOK, d.State())
+	<-d.Writable()
+
+	_, err = NewDiskMonitor(dir, 90, 80, nil)
+	require.Error(t, err)
+	_, err = NewDiskMonitor(dir, 0, 0, nil)
+	require.Error(t, err)
+
+	// without soft watermark nothing is deleted
+	writeFile(t, filepath.Join(dir, "a/a-20210101_000000-20210101_235959.log"), 300, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(dir, "notes.txt"), 300, now)
+	d, err = NewDiskMonitor(dir, 0, 95, NewRetention(wm))
+	require.NoError(t, err)
+	d.usage = dirUsage
+	require.NoError(t, d.Check(now))
+	require.Equal(t, DiskFull, d.State())
+	require.Equal(t, []string{"a/a-20210101_000000-20210101_235959.log", "a/a.log", "notes.txt"}, listFiles(t, dir))
+}
+
+func TestRejectDiskFull(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskMonitor(dir, 80, 90, nil)
+	require.NoError(t, err)
+	d.usage = func(string) (uint64, uint64, error) {
+		return 50, 1000, nil
+	}
+	require.NoError(t, d.Check(time.Now()))
+	srv := startTestServer(t, dir, WithDiskMonitor(d))
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{Name: "test", Version: 1}))
+	resp, err := common.ReadConnectResponse(conn)
+	require.NoError(t, err)
+	require.False(t, resp.Success)
+	require.Equal(t, StatusDiskFull, resp.Status)
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskUsage returns bytes available to unprivileged users and total bytes of the file system
+// of dir.
+func diskUsage(dir string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
+
+// syncDir fsyncs directory dir so entries created or renamed in it are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
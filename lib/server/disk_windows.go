@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package server
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskUsage returns bytes available to the user and total bytes of the volume of dir.
+func diskUsage(dir string) (free, total uint64, err error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalFree uint64
+	r, _, e := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)),
+		uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&totalFree)))
+	if r == 0 {
+		return 0, 0, e
+	}
+	return free, total, nil
+}
+
+// syncDir does nothing, directories can't be fsynced on windows, entries are durable once the
+// file is fsynced.
+func syncDir(string) error {
+	return nil
+}
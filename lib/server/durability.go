@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode is when written data is fsynced to disk.
+type SyncMode string
+
+const (
+	// SyncNone leaves flushing to the OS, a host crash can lose recent writes.
+	SyncNone SyncMode = "none"
+	// SyncInterval fsyncs a file at most Interval after it is written.
+	SyncInterval SyncMode = "interval"
+	// SyncBytes fsyncs a file after every Bytes written.
+	SyncBytes SyncMode = "bytes"
+	// SyncAck fsyncs before acknowledging frames to clients, data of clients without acks is
+	// fsynced at most Interval after it is written.
+	SyncAck SyncMode = "ack"
+
+	defaultSyncInterval = time.Second
+	defaultSyncBytes    = 1 << 20
+)
+
+// SyncPolicy configures durability of log files, zero fields inherit the default. Files and
+// directories are also fsynced when files are created and rotated unless mode is none.
+type SyncPolicy struct {
+	Mode     SyncMode `json:"mode,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Bytes    uint64   `json:"bytes,omitempty"`
+}
+
+// Validate checks mode and values of policy.
+func (p SyncPolicy) Validate() error {
+	switch p.Mode {
+	case "", SyncNone, SyncInterval, SyncBytes, SyncAck:
+	default:
+		return fmt.Errorf("unknown sync mode %s", p.Mode)
+	}
+	if p.Interval < 0 {
+		return fmt.Errorf("sync interval must not be negative")
+	}
+	return nil
+}
+
+// merge returns p with zero fields taken from def.
+func (p SyncPolicy) merge(def SyncPolicy) SyncPolicy {
+	if p.Mode == "" {
+		p.Mode = def.Mode
+	}
+	if p.Interval == 0 {
+		p.Interval = def.Interval
+	}
+	if p.Bytes == 0 {
+		p.Bytes = def.Bytes
+	}
+	return p
+}
+
+// enabled reports whether files are fsynced at all.
+func (p SyncPolicy) enabled() bool {
+	return p.Mode != "" && p.Mode != SyncNone
+}
+
+// interval returns delay of fsync after a write, 0 if writes aren't fsynced by time.
+func (p SyncPolicy) interval() time.Duration {
+	if p.Mode != SyncInterval && p.Mode != SyncAck {
+		return 0
+	}
+	if p.Interval <= 0 {
+		return defaultSyncInterval
+	}
+	return time.Duration(p.Interval)
+}
+
+// bytes returns bytes written before fsync, 0 if writes aren't fsynced by size.
+func (p SyncPolicy) bytes() uint64 {
+	if p.Mode != SyncBytes {
+		return 0
+	}
+	if p.Bytes == 0 {
+		return defaultSyncBytes
+	}
+	return p.Bytes
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+func unsynced(w *RotateLogWriter) uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.unsynced
+}
+
+func newSyncTestWriter(t *testing.T, policy SyncPolicy) *RotateLogWriter {
+	dir := t.TempDir()
+	w := newRotateLogWriter(RotationPolicy{}, func(time.Time) string {
+		return filepath.Join(dir, "app.log")
+	}, func(current string, _, _ time.Time) string {
+		return filepath.Join(dir, "app-1.log")
+	})
+	w.sync = policy
+	t.Cleanup(func() {
+		_ = w.Close()
+	})
+	return w
+}
+
+func TestSyncBytes(t *testing.T) {
+	w := newSyncTestWriter(t, SyncPolicy{Mode: SyncBytes, Bytes: 10})
+	_, err := w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), unsynced(w))
+	_, err = w.Write([]byte("line 2\n"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), unsynced(w))
+	require.NoError(t, w.Rotate())
+}
+
+func TestSyncInterval(t *testing.T) {
+	w := newSyncTestWriter(t, SyncPolicy{Mode: SyncInterval, Interval: Duration(10 * time.Millisecond)})
+	_, err := w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), unsynced(w))
+	require.Eventually(t, func() bool {
+		return unsynced(w) == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// no timed fsync without mode
+	w = newSyncTestWriter(t, SyncPolicy{Interval: Duration(time.Millisecond)})
+	_, err = w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, uint64(5), unsynced(w))
+}
+
+func TestSyncBeforeAck(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	a := newAcker(zap.S(), server)
+	synced := 0
+	a.sync = func() error {
+		synced++
+		return nil
+	}
+	a.update(3)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.flush()
+	}()
+	f, err := common.ReadFrame(client, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), f.Seq)
+	require.NoError(t, <-done)
+	require.Equal(t, 1, synced)
+
+	// nothing new to ack
+	require.NoError(t, a.flush())
+	require.Equal(t, 1, synced)
+
+	// frames are not acknowledged if they can't be synced
+	a.sync = func() error {
+		return errors.New("disk error")
+	}
+	a.update(4)
+	require.Error(t, a.flush())
+	require.Equal(t, uint64(3), a.sent)
+
+	// ack loop closes connection so client resends the frames after reconnect
+	a.start()
+	_, err = common.ReadFrame(client, nil)
+	require.Error(t, err)
+	a.stop()
+	require.True(t, a.failed)
+}
+
+func TestSyncPolicy(t *testing.T) {
+	var p SyncPolicy
+	require.NoError(t, json.Unmarshal([]byte(`{"mode": "interval", "interval": "200ms"}`), &p))
+	require.NoError(t, p.Validate())
+	require.Equal(t, 200*time.Millisecond, p.interval())
+	require.Equal(t, uint64(0), p.bytes())
+	p = SyncPolicy{}.merge(SyncPolicy{Mode: SyncBytes})
+	require.True(t, p.enabled())
+	require.Equal(t, uint64(defaultSyncBytes), p.bytes())
+	require.Equal(t, defaultSyncInterval, SyncPolicy{Mode: SyncAck}.interval())
+	require.False(t, SyncPolicy{Mode: SyncNone}.enabled())
+	require.Error(t, SyncPolicy{Mode: "always"}.Validate())
+}
+
+func TestSyncFailed(t *testing.T) {
+	w := newSyncTestWriter(t, SyncPolicy{Mode: SyncBytes})
+	_, err := w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	before := fsyncFailed.Value()
+	w.lock.Lock()
+	require.NoError(t, w.currentFile.Close())
+	w.lock.Unlock()
+	require.Error(t, w.Sync())
+	require.Equal(t, before+1, fsyncFailed.Value())
+}
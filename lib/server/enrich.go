@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+// EnrichMode decides how server adds sender context to each line of a stream.
+type EnrichMode string
+
+const (
+	// EnrichNone writes lines as received.
+	EnrichNone EnrichMode = "none"
+	// EnrichPrefix prefixes text lines with receive time, remote address, client host, instance,
+	// connection id and labels, json lines get those as fields instead.
+	EnrichPrefix EnrichMode = "prefix"
+	// EnrichWrap wraps text lines into a json object with those fields and the line as msg,
+	// json lines get the fields injected.
+	EnrichWrap EnrichMode = "wrap"
+)
+
+const (
+	enrichTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// enrichWriter adds ConnectionInfo to each line written to it, it expects whole lines which
+// lineWriter provides.
+type enrichWriter struct {
+	w    io.Writer
+	mode EnrichMode
+	// fields is json fields of info without braces, prefix is text form of info.
+	fields []byte
+	prefix []byte
+	buf    []byte
+	now    func() time.Time
+}
+
+func newEnrichWriter(w io.Writer, mode EnrichMode, info ConnectionInfo) *enrichWriter {
+	e := &enrichWriter{
+		w:    w,
+		mode: mode,
+		now:  time.Now,
+	}
+	e.fields = appendJSONField(e.fields, "remote_addr", info.RemoteAddr)
+	if info.Hostname != "" {
+		e.fields = appendJSONField(append(e.fields, ','), "client_host", info.Hostname)
+	}
+	if info.InstanceID != "" {
+		e.fields = appendJSONField(append(e.fields, ','), "instance_id", info.InstanceID)
+	}
+	e.fields = append(e.fields, `,"conn_id":`...)
+	e.fields = strconv.AppendUint(e.fields, info.ID, 10)
+	if len(info.Labels) > 0 {
+		labels, _ := json.Marshal(info.Labels)
+		e.fields = append(e.fields, `,"labels":`...)
+		e.fields = append(e.fields, labels...)
+	}
+
+	e.prefix = append(e.prefix, info.RemoteAddr...)
+	e.prefix = append(e.prefix, ' ')
+	host := info.Hostname
+	if host == "" {
+		host = "-"
+	}
+	e.prefix = appendPrefixToken(e.prefix, host)
+	if info.InstanceID != "" {
+		e.prefix = append(e.prefix, '/')
+		e.prefix = appendPrefixToken(e.prefix, info.InstanceID)
+	}
+	e.prefix = append(e.prefix, " conn="...)
+	e.prefix = strconv.AppendUint(e.prefix, info.ID, 10)
+	for _, k := range common.SortedLabelKeys(info.Labels) {
+		e.prefix = append(e.prefix, ' ')
+		e.prefix = appendPrefixToken(e.prefix, k)
+		e.prefix = append(e.prefix, '=')
+		e.prefix = appendPrefixToken(e.prefix, info.Labels[k])
+	}
+	e.prefix = append(e.prefix, ' ')
+	return e
+}
+
+// appendPrefixToken appends s with spaces and control chars replaced, so a client can't forge
+// lines or fields by its hostname.
+func appendPrefixToken(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == 0x7f {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func appendJSONField(dst []byte, key, value string) []byte {
+	dst = appendJSONString(dst, key)
+	dst = append(dst, ':')
+	return appendJSONString(dst, value)
+}
+
+func appendJSONString(dst []byte, s string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return append(dst, bytes.TrimRight(b.Bytes(), "\n")...)
+}
+
+// Write enriches each line of p and writes them in one write, it returns len(p) on success.
+func (e *enrichWriter) Write(p []byte) (int, error) {
+	ts := e.now().Format(enrichTimeFormat)
+	e.buf = e.buf[:0]
+	for data := p; len(data) > 0; {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		e.buf = e.enrichLine(e.buf, ts, line)
+		e.buf = append(e.buf, '\n')
+	}
+	n, err := e.w.Write(e.buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(e.buf) {
+		return 0, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+// enrichRecord enriches data of a record as one unit, so a multi-line record gets one prefix.
+func (e *enrichWriter) enrichRecord(dst []byte, ts string, data []byte) []byte {
+	if n := len(data); n > 0 && data[n-1] == '\n' {
+		data = data[:n-1]
+	}
+	return e.enrichLine(dst, ts, data)
+}
+
+func (e *enrichWriter) enrichLine(dst []byte, ts string, line []byte) []byte {
+	trimmed := bytes.TrimRight(line, " \r\t")
+	if len(trimmed) >= 2 && trimmed[0] == '{' && trimmed[len(trimmed)-1] == '}' {
+		dst = append(dst, `{"recv_ts":"`...)
+		dst = append(dst, ts...)
+		dst = append(dst, `",`...)
+		dst = append(dst, e.fields...)
+		if len(bytes.TrimSpace(trimmed[1:len(trimmed)-1])) > 0 {
+			dst = append(dst, ',')
+		}
+		return append(dst, line[1:]...)
+	}
+	if e.mode == EnrichWrap {
+		dst = append(dst, `{"recv_ts":"`...)
+		dst = append(dst, ts...)
+		dst = append(dst, `",`...)
+		dst = append(dst, e.fields...)
+		dst = append(dst, `,"msg":`...)
+		dst = appendJSONString(dst, string(bytes.TrimRight(line, "\r")))
+		return append(dst, '}')
+	}
+	dst = append(dst, ts...)
+	dst = append(dst, ' ')
+	dst = append(dst, e.prefix...)
+	return append(dst, line...)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichWriter(t *testing.T) {
+	info := ConnectionInfo{RemoteAddr: "10.0.0.1:5000", Hostname: "web 1\n", InstanceID: "i-1", ID: 7,
+		Labels: map[string]string{"region": "sg", "env": "prod"}}
+	now := func() time.Time {
+		return time.Date(2021, 3, 4, 5, 6, 7, 123456000, time.UTC)
+	}
+	var out bytes.Buffer
+
+	e := newEnrichWriter(&out, EnrichPrefix, info)
+	e.now = now
+	input := "text line\n{\"level\":\"info\",\"msg\":\"m\"}\n{}\n"
+	n, err := e.Write([]byte(input))
+	require.NoError(t, err)
+	require.Equal(t, len(input), n)
+	lines := bytes.Split(bytes.TrimRight(out.Bytes(), "\n"), []byte("\n"))
+	require.Len(t, lines, 3)
+	require.Equal(t, "2021-03-04T05:06:07.123456Z 10.0.0.1:5000 web_1_/i-1 conn=7 env=prod region=sg text line", string(lines[0]))
+	var obj map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[1], &obj))
+	require.Equal(t, "info", obj["level"])
+	require.Equal(t, "web 1\n", obj["client_host"])
+	require.Equal(t, "i-1", obj["instance_id"])
+	require.Equal(t, float64(7), obj["conn_id"])
+	require.Equal(t, "2021-03-04T05:06:07.123456Z", obj["recv_ts"])
+	require.Equal(t, map[string]interface{}{"env": "prod", "region": "sg"}, obj["labels"])
+	require.NoError(t, json.Unmarshal(lines[2], &obj))
+
+	out.Reset()
+	e = newEnrichWriter(&out, EnrichWrap, ConnectionInfo{RemoteAddr: "10.0.0.1:5000", ID: 8})
+	e.now = now
+	_, err = e.Write([]byte("a <b> \"c\"\r\n"))
+	require.NoError(t, err)
+	obj = nil
+	require.NoError(t, json.Unmarshal(out.Bytes(), &obj))
+	require.Equal(t, "a <b> \"c\"", obj["msg"])
+	require.Equal(t, "10.0.0.1:5000", obj["remote_addr"])
+	require.NotContains(t, obj, "client_host")
+}
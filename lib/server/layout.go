@@ -0,0 +1,366 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFileTemplate is where log of a stream is written, relative to base dir.
+	DefaultFileTemplate = "{name}/{name}.log"
+	// DefaultBackupTemplate is the name of a rotated file, in the directory of the log file.
+	DefaultBackupTemplate = "{base}-{yyyy}{mm}{dd}_{hh}{mi}{ss}-{end.yyyy}{end.mm}{end.dd}_{end.hh}{end.mi}{end.ss}{ext}"
+
+	unknownValue = "unknown"
+)
+
+// Layout renders paths of log files from templates. Placeholders are {name}, {host},
+// {instance}, {label.<key>} from handshake and {yyyy}, {mm}, {dd}, {hh}, {mi}, {ss} of the
+// time file is opened. Backup template also has {base} and {ext} of the log file name, its time
+// placeholders are of the first write to the file and {end.yyyy} .. {end.ss} of the last write.
+// Times are in loc. Values are sanitized so a client can't escape base dir.
+type Layout struct {
+	file   template
+	backup template
+	loc    *time.Location
+}
+
+// template is a parsed path template, parts alternate between literal and placeholder.
+type template struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	token   string
+}
+
+// streamVars are values of handshake placeholders.
+type streamVars struct {
+	name     string
+	host     string
+	instance string
+	labels   map[string]string
+}
+
+func streamVarsOf(info ConnectionInfo) streamVars {
+	return streamVars{name: info.Name, host: info.Hostname, instance: info.InstanceID, labels: info.Labels}
+}
+
+var (
+	fileTokens   = []string{"name", "host", "instance", "yyyy", "mm", "dd", "hh", "mi", "ss"}
+	backupTokens = []string{"base", "ext", "yyyy", "mm", "dd", "hh", "mi", "ss",
+		"end.yyyy", "end.mm", "end.dd", "end.hh", "end.mi", "end.ss"}
+	timeTokens = map[string]string{"yyyy": "2006", "mm": "01", "dd": "02", "hh": "15", "mi": "04", "ss": "05"}
+)
+
+// NewLayout parses file and backup templates, empty ones use the defaults. Times are rendered
+// in UTC, see WithLocation.
+func NewLayout(fileTemplate, backupTemplate string) (*Layout, error) {
+	if fileTemplate == "" {
+		fileTemplate = DefaultFileTemplate
+	}
+	if backupTemplate == "" {
+		backupTemplate = DefaultBackupTemplate
+	}
+	file, err := parseTemplate(fileTemplate, fileTokens, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file template, %w", err)
+	}
+	if !file.has("name") {
+		return nil, fmt.Errorf("file template must contain {name}")
+	}
+	backup, err := parseTemplate(backupTemplate, backupTokens, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup template, %w", err)
+	}
+	if strings.ContainsRune(backupTemplate, '/') {
+		return nil, fmt.Errorf("backup template must be a file name")
+	}
+	if !backup.hasTime() {
+		return nil, fmt.Errorf("backup template must contain time, so backups don't overwrite each other")
+	}
+	return &Layout{file: file, backup: backup, loc: time.UTC}, nil
+}
+
+// WithLocation returns a copy of layout which renders times in loc.
+func (l *Layout) WithLocation(loc *time.Location) *Layout {
+	c := *l
+	c.loc = loc
+	return &c
+}
+
+func parseTemplate(s string, tokens []string, labels bool) (template, error) {
+	var t template
+	if path.IsAbs(s) || strings.HasSuffix(s, "/") {
+		return t, fmt.Errorf("template must be a relative file path")
+	}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return t, fmt.Errorf("unclosed placeholder in %s", s)
+		}
+		token := s[i+1 : i+j]
+		if !isToken(token, tokens) && !(labels && strings.HasPrefix(token, "label.") && len(token) > 6) {
+			return t, fmt.Errorf("unknown placeholder {%s}", token)
+		}
+		t.parts = append(t.parts, templatePart{token: token})
+		s = s[i+j+1:]
+	}
+	for _, p := range t.parts {
+		if p.literal == "" {
+			continue
+		}
+		if strings.ContainsAny(p.literal, "\\}") {
+			return t, fmt.Errorf("invalid literal %q", p.literal)
+		}
+		for _, seg := range strings.Split(p.literal, "/") {
+			if seg == ".." {
+				return t, fmt.Errorf("template must not contain '..'")
+			}
+		}
+	}
+	return t, nil
+}
+
+func isToken(token string, tokens []string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (t template) has(token string) bool {
+	for _, p := range t.parts {
+		if p.token == token {
+			return true
+		}
+	}
+	return false
+}
+
+func (t template) hasTime() bool {
+	for _, p := range t.parts {
+		if _, ok := timeTokens[strings.TrimPrefix(p.token, "end.")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// render replaces placeholders by value returned by fn.
+func (t template) render(fn func(token string) string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.token == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		b.WriteString(fn(p.token))
+	}
+	return b.String()
+}
+
+// sanitize makes value safe as a path segment, chars other than alphanumeric, '.', '-' and '_'
+// are replaced, and a leading '.' too so "." and ".." can't be formed.
+func sanitize(value string) string {
+	if value == "" {
+		return unknownValue
+	}
+	b := []byte(value)
+	for i, c := range b {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' ||
+			c == '.' && i > 0
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func (v streamVars) value(token string) string {
+	switch token {
+	case "name":
+		return sanitize(v.name)
+	case "host":
+		return sanitize(v.host)
+	case "instance":
+		return sanitize(v.instance)
+	}
+	if strings.HasPrefix(token, "label.") {
+		return sanitize(v.labels[strings.TrimPrefix(token, "label.")])
+	}
+	return ""
+}
+
+// path returns path of log file relative to base dir for a file opened at t.
+func (l *Layout) path(v streamVars, t time.Time) string {
+	t = t.In(l.loc)
+	p := l.file.render(func(token string) string {
+		if layout, ok := timeTokens[token]; ok {
+			return t.Format(layout)
+		}
+		return v.value(token)
+	})
+	return filepath.FromSlash(path.Clean("/" + p))[1:]
+}
+
+// key identifies the writer of stream vars, streams with the same key share a writer. Time
+// placeholders are kept so one writer moves to a new file when date changes.
+func (l *Layout) key(v streamVars) string {
+	return l.file.render(func(token string) string {
+		if _, ok := timeTokens[token]; ok {
+			return "{" + token + "}"
+		}
+		return v.value(token)
+	})
+}
+
+// backupPath returns path of backup for log file at current which was written from first to last.
+func (l *Layout) backupPath(current string, first, last time.Time) string {
+	first, last = first.In(l.loc), last.In(l.loc)
+	dir, file := filepath.Split(current)
+	ext := filepath.Ext(file)
+	base := file[:len(file)-len(ext)]
+	return filepath.Join(dir, l.backup.render(func(token string) string {
+		switch token {
+		case "base":
+			return base
+		case "ext":
+			return ext
+		}
+		if strings.HasPrefix(token, "end.") {
+			return last.Format(timeTokens[strings.TrimPrefix(token, "end.")])
+		}
+		return first.Format(timeTokens[token])
+	}))
+}
+
+// valuePattern matches a sanitized placeholder value.
+const valuePattern = `[A-Za-z0-9_-][A-Za-z0-9._-]*`
+
+// layoutMatcher finds log files and backups the layout renders under base dir, and the stream
+// name they belong to.
+type layoutMatcher struct {
+	file   *regexp.Regexp
+	backup *regexp.Regexp
+}
+
+// matcher returns matcher of slash separated paths relative to base dir.
+func (l *Layout) matcher() *layoutMatcher {
+	var dir, base []templatePart
+	ext := ""
+	parts := l.file.parts
+	last := len(parts) - 1
+	// ext is the literal extension of file name, like ".log"
+	if lit := parts[last].literal; parts[last].token == "" {
+		if i := strings.LastIndexByte(lit, '.'); i >= 0 && !strings.Contains(lit[i:], "/") {
+			ext = lit[i:]
+			parts = append(append([]templatePart{}, parts[:last]...), templatePart{literal: lit[:i]})
+		}
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		if j := strings.LastIndexByte(parts[i].literal, '/'); j >= 0 {
+			dir = append(append([]templatePart{}, parts[:i]...), templatePart{literal: parts[i].literal[:j+1]})
+			base = append([]templatePart{{literal: parts[i].literal[j+1:]}}, parts[i+1:]...)
+			break
+		}
+	}
+	if dir == nil {
+		base = parts
+	}
+	pattern := func(parts []templatePart) string {
+		var b strings.Builder
+		for _, p := range parts {
+			switch {
+			case p.token == "":
+				b.WriteString(regexp.QuoteMeta(p.literal))
+			case p.token == "name":
+				b.WriteString("(" + valuePattern + ")")
+			case timeTokens[strings.TrimPrefix(p.token, "end.")] != "":
+				b.WriteString(fmt.Sprintf(`\d{%d}`, len(timeTokens[strings.TrimPrefix(p.token, "end.")])))
+			default:
+				b.WriteString(valuePattern)
+			}
+		}
+		return b.String()
+	}
+	dirRe := pattern(dir)
+	baseRe := pattern(base)
+	var backupRe strings.Builder
+	for _, p := range l.backup.parts {
+		switch p.token {
+		case "base":
+			backupRe.WriteString(baseRe)
+		case "ext":
+			backupRe.WriteString(regexp.QuoteMeta(ext))
+		default:
+			backupRe.WriteString(pattern([]templatePart{p}))
+		}
+	}
+	return &layoutMatcher{
+		file:   regexp.MustCompile("^" + dirRe + baseRe + regexp.QuoteMeta(ext) + "$"),
+		backup: regexp.MustCompile("^" + dirRe + backupRe.String() + "$"),
+	}
+}
+
+// numberedBackup matches number added to backups covering the same range.
+var numberedBackup = regexp.MustCompile(`\.\d+(\.[^./]*)?$`)
+
+// match returns stream name of path, and whether it is a backup. Compressed and numbered
+// backups match too.
+func (m *layoutMatcher) match(path string, compressExts ...string) (name string, backup bool, ok bool) {
+	// backups are checked first, a placeholder value in file pattern can match a backup name
+	unpacked := path
+	for _, ext := range compressExts {
+		unpacked = strings.TrimSuffix(unpacked, ext)
+	}
+	candidates := []string{unpacked}
+	if loc := numberedBackup.FindStringSubmatchIndex(unpacked); loc != nil {
+		unnumbered := unpacked[:loc[0]]
+		if loc[2] >= 0 {
+			unnumbered += unpacked[loc[2]:loc[3]]
+		}
+		candidates = append(candidates, unnumbered)
+	}
+	for _, c := range candidates {
+		if name, ok := groupName(m.backup.FindStringSubmatch(c)); ok {
+			return name, true, true
+		}
+	}
+	if name, ok := groupName(m.file.FindStringSubmatch(path)); ok {
+		return name, false, true
+	}
+	return "", false, false
+}
+
+// groupName returns stream name captured by groups, all {name} placeholders must have the same
+// value. Backup template may not contain it, name is empty then.
+func groupName(groups []string) (string, bool) {
+	if groups == nil {
+		return "", false
+	}
+	if len(groups) < 2 {
+		return "", true
+	}
+	for _, g := range groups[2:] {
+		if g != groups[1] {
+			return "", false
+		}
+	}
+	return groups[1], true
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	l, err := NewLayout("{name}/{yyyy}/{mm}/{dd}/{name}-{host}-{label.env}.log", "")
+	require.NoError(t, err)
+	ts := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	v := streamVars{name: "app", host: "web-1", labels: map[string]string{"env": "prod"}}
+	require.Equal(t, filepath.FromSlash("app/2021/02/03/app-web-1-prod.log"), l.path(v, ts))
+	require.Equal(t, "app/{yyyy}/{mm}/{dd}/app-web-1-prod.log", l.key(v))
+	require.Equal(t, filepath.FromSlash("app/2021/02/03/app-web-1-prod-20210203_040506-20210203_235959.log"),
+		l.backupPath(l.path(v, ts), ts, ts.Add(20*time.Hour-5*time.Minute-7*time.Second)))
+
+	// times are rendered in location of layout
+	loc := time.FixedZone("UTC+7", 7*3600)
+	local := l.WithLocation(loc)
+	ts = time.Date(2021, 2, 3, 20, 0, 0, 0, time.UTC)
+	require.Equal(t, filepath.FromSlash("app/2021/02/04/app-web-1-prod.log"), local.path(v, ts))
+	require.Equal(t, filepath.FromSlash("app/2021/02/03/app-web-1-prod.log"), l.path(v, ts.In(loc)))
+	require.Equal(t, filepath.FromSlash("app/app-20210204_030000-20210204_040000.log"),
+		local.backupPath(filepath.FromSlash("app/app.log"), ts, ts.Add(time.Hour)))
+
+	// values can't escape base dir
+	v = streamVars{name: "app", host: "../../etc", labels: map[string]string{"env": ".."}}
+	require.Equal(t, filepath.FromSlash("app/2021/02/03/app-_._.._etc-_..log"), l.path(v, ts))
+	v = streamVars{name: "app"}
+	require.Equal(t, filepath.FromSlash("app/2021/02/03/app-unknown-unknown.log"), l.path(v, ts))
+
+	for _, tmpl := range []string{"/var/{name}.log", "../{name}.log", "{name}/../x.log", "{name}/", "{host}.log",
+		"{name}-{foo}.log", "{name"} {
+		_, err = NewLayout(tmpl, "")
+		require.Error(t, err, tmpl)
+	}
+	_, err = NewLayout("", "{base}{ext}")
+	require.Error(t, err)
+	_, err = NewLayout("", "old/{base}-{yyyy}{ext}")
+	require.Error(t, err)
+	_, err = NewLayout("", "{base}-{end.yyyy}{end.mm}{end.dd}{ext}")
+	require.NoError(t, err)
+}
+
+func TestWriterManLayout(t *testing.T) {
+	baseDir := t.TempDir()
+	l, err := NewLayout("{name}/{yyyy}{mm}{dd}/{name}-{label.pod}.log", "")
+	require.NoError(t, err)
+	wm := NewWriterMan(baseDir, 1<<30, WithLayout(l))
+	a := wm.GetOrCreateFor(ConnectionInfo{Name: "app", Labels: map[string]string{"pod": "a"}})
+	b := wm.GetOrCreateFor(ConnectionInfo{Name: "app", Labels: map[string]string{"pod": "b"}})
+	require.NotSame(t, a, b)
+	require.Same(t, a, wm.GetOrCreateFor(ConnectionInfo{Name: "app", Labels: map[string]string{"pod": "a"}}))
+	_, err = a.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, a.Close())
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "app", time.Now().UTC().Format("20060102"), "app-a.log"))
+	require.NoError(t, err)
+	require.Equal(t, "line\n", string(data))
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	defaultMaxLineLength = 1 << 20
+)
+
+// lineWriter only writes whole lines to a writer shared by connections of the same name, so
+// lines of different clients don't interleave. Incomplete tail of a write is kept until the
+// next write completes it. A tail longer than maxLine is written with a newline appended.
+type lineWriter struct {
+	w       io.Writer
+	tail    []byte
+	maxLine int
+	// split counts lines broken because they exceeded maxLine.
+	split int
+}
+
+func newLineWriter(w io.Writer, maxLine int) *lineWriter {
+	if maxLine <= 0 {
+		maxLine = defaultMaxLineLength
+	}
+	return &lineWriter{w: w, maxLine: maxLine}
+}
+
+// Write writes complete lines of tail and p, it returns len(p) unless the underlying write failed.
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	i := bytes.LastIndexByte(p, '\n')
+	if i < 0 {
+		lw.tail = append(lw.tail, p...)
+		if err := lw.splitLong(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	lines := p[:i+1]
+	if len(lw.tail) > 0 {
+		lw.tail = append(lw.tail, lines...)
+		lines = lw.tail
+	}
+	if err := lw.write(lines); err != nil {
+		return 0, err
+	}
+	lw.tail = append(lw.tail[:0], p[i+1:]...)
+	if err := lw.splitLong(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// splitLong writes tail as a line if it exceeds maxLine.
+func (lw *lineWriter) splitLong() error {
+	for len(lw.tail) > lw.maxLine {
+		line := make([]byte, 0, lw.maxLine+1)
+		line = append(append(line, lw.tail[:lw.maxLine]...), '\n')
+		if err := lw.write(line); err != nil {
+			return err
+		}
+		lw.split++
+		lw.tail = append(lw.tail[:0], lw.tail[lw.maxLine:]...)
+	}
+	return nil
+}
+
+func (lw *lineWriter) write(data []byte) error {
+	n, err := lw.w.Write(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// pending returns length of the incomplete tail which is not written yet.
+func (lw *lineWriter) pending() int {
+	return len(lw.tail)
+}
+
+// Flush writes incomplete tail with a newline appended, it is called when connection ends.
+func (lw *lineWriter) Flush() error {
+	if len(lw.tail) == 0 {
+		return nil
+	}
+	lw.tail = append(lw.tail, '\n')
+	err := lw.write(lw.tail)
+	lw.tail = lw.tail[:0]
+	return err
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineWriter(t *testing.T) {
+	var out bytes.Buffer
+	a := newLineWriter(&out, 8)
+	b := newLineWriter(&out, 8)
+
+	n, err := a.Write([]byte("a1\na2"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	_, err = b.Write([]byte("b1"))
+	require.NoError(t, err)
+	_, err = a.Write([]byte("-end\na3"))
+	require.NoError(t, err)
+	_, err = b.Write([]byte("-end\n"))
+	require.NoError(t, err)
+	require.Equal(t, "a1\na2-end\nb1-end\n", out.String())
+
+	// a line longer than max length is split
+	out.Reset()
+	_, err = b.Write([]byte("0123456789abcdefghij"))
+	require.NoError(t, err)
+	require.Equal(t, "01234567\n89abcdef\n", out.String())
+	require.Equal(t, 2, b.split)
+
+	out.Reset()
+	require.NoError(t, a.Flush())
+	require.NoError(t, b.Flush())
+	require.Equal(t, "a3\nghij\n", out.String())
+	require.NoError(t, a.Flush())
+	require.Equal(t, "a3\nghij\n", out.String())
+}
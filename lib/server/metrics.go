@@ -0,0 +1,29 @@
+package server
+
+import "expvar"
+
+// metrics are published by expvar under "cclog", admin API serves them at /debug/vars.
+var (
+	metrics = expvar.NewMap("cclog")
+
+	diskFreeBytes        = new(expvar.Int)
+	diskUsedPercent      = new(expvar.Float)
+	diskStateVar         = new(expvar.String)
+	rejectedDiskFull     = new(expvar.Int)
+	retentionDeleted     = new(expvar.Int)
+	retentionDeletedSize = new(expvar.Int)
+	writersEvicted       = new(expvar.Int)
+	fsyncFailed          = new(expvar.Int)
+)
+
+func init() {
+	diskStateVar.Set(DiskOK.String())
+	metrics.Set("disk_free_bytes", diskFreeBytes)
+	metrics.Set("disk_used_percent", diskUsedPercent)
+	metrics.Set("disk_state", diskStateVar)
+	metrics.Set("handshakes_rejected_disk_full", rejectedDiskFull)
+	metrics.Set("retention_deleted_files", retentionDeleted)
+	metrics.Set("retention_deleted_bytes", retentionDeletedSize)
+	metrics.Set("writers_evicted", writersEvicted)
+	metrics.Set("fsync_failed", fsyncFailed)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+// recordWriter decodes batches of records and writes data of each record as a whole, ended
+// with a newline, so multi-line records are not interleaved with other connections. Time, level
+// and labels of a record are injected as record_ts, record_level and record_labels fields if its
+// data is a json object, or prefix its data otherwise. Records are enriched as a unit if enrich
+// is set.
+type recordWriter struct {
+	w      io.Writer
+	enrich *enrichWriter
+	buf    []byte
+	meta   []byte
+}
+
+func newRecordWriter(w io.Writer, enrich *enrichWriter) *recordWriter {
+	return &recordWriter{w: w, enrich: enrich}
+}
+
+// Write writes all records of batch p in one write, it returns len(p) on success. Nothing is
+// written if p can't be decoded.
+func (rw *recordWriter) Write(p []byte) (int, error) {
+	rw.buf = rw.buf[:0]
+	var ts string
+	if rw.enrich != nil {
+		ts = rw.enrich.now().Format(enrichTimeFormat)
+	}
+	err := common.ForEachRecord(p, func(r common.Record) error {
+		data := rw.withMeta(r)
+		if rw.enrich != nil {
+			rw.buf = rw.enrich.enrichRecord(rw.buf, ts, data)
+		} else {
+			rw.buf = append(rw.buf, data...)
+		}
+		if len(rw.buf) == 0 || rw.buf[len(rw.buf)-1] != '\n' {
+			rw.buf = append(rw.buf, '\n')
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("invalid records batch of %d bytes, %w", len(p), err)
+	}
+	n, err := rw.w.Write(rw.buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(rw.buf) {
+		return 0, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+// withMeta returns data of r with its time, level and labels added, data is returned as is if
+// r has none of them.
+func (rw *recordWriter) withMeta(r common.Record) []byte {
+	if r.Time.IsZero() && r.Level == "" && len(r.Labels) == 0 {
+		return r.Data
+	}
+	b := rw.meta[:0]
+	trimmed := bytes.TrimRight(r.Data, " \r\t\n")
+	if len(trimmed) >= 2 && trimmed[0] == '{' && trimmed[len(trimmed)-1] == '}' {
+		b = append(b, '{')
+		if !r.Time.IsZero() {
+			b = append(b, `"record_ts":"`...)
+			b = append(b, r.Time.UTC().Format(enrichTimeFormat)...)
+			b = append(b, `",`...)
+		}
+		if r.Level != "" {
+			b = appendJSONField(b, "record_level", r.Level)
+			b = append(b, ',')
+		}
+		if len(r.Labels) > 0 {
+			labels, _ := json.Marshal(r.Labels)
+			b = append(b, `"record_labels":`...)
+			b = append(append(b, labels...), ',')
+		}
+		if len(bytes.TrimSpace(trimmed[1:len(trimmed)-1])) == 0 {
+			// empty object, drop the trailing comma
+			b = b[:len(b)-1]
+		}
+		b = append(b, r.Data[1:]...)
+	} else {
+		if !r.Time.IsZero() {
+			b = append(b, r.Time.UTC().Format(enrichTimeFormat)...)
+			b = append(b, ' ')
+		}
+		if r.Level != "" {
+			b = append(appendPrefixToken(b, r.Level), ' ')
+		}
+		for _, k := range common.SortedLabelKeys(r.Labels) {
+			b = appendPrefixToken(b, k)
+			b = append(b, '=')
+			b = append(appendPrefixToken(b, r.Labels[k]), ' ')
+		}
+		b = append(b, r.Data...)
+	}
+	rw.meta = b
+	return b
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+func TestRecordWriterMeta(t *testing.T) {
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 123456000, time.UTC)
+	var batch []byte
+	for _, r := range []common.Record{
+		{Time: ts, Level: "error", Labels: map[string]string{"env": "prod", "pod": "a 1"},
+			Data: []byte("panic: boom\n\tat main.go:10\n")},
+		{Level: "info", Labels: map[string]string{"env": "prod"}, Data: []byte(`{"msg":"m"}`)},
+		{Time: ts, Data: []byte("{}")},
+		{Data: []byte("plain")},
+	} {
+		var err error
+		batch, err = common.AppendRecord(batch, r)
+		require.NoError(t, err)
+	}
+	var out bytes.Buffer
+	rw := newRecordWriter(&out, nil)
+	n, err := rw.Write(batch)
+	require.NoError(t, err)
+	require.Equal(t, len(batch), n)
+
+	lines := bytes.Split(bytes.TrimRight(out.Bytes(), "\n"), []byte("\n"))
+	require.Len(t, lines, 5)
+	require.Equal(t, "2021-03-04T05:06:07.123456Z error env=prod pod=a_1 panic: boom", string(lines[0]))
+	require.Equal(t, "\tat main.go:10", string(lines[1]))
+	var obj map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[2], &obj))
+	require.Equal(t, map[string]interface{}{"msg": "m", "record_level": "info",
+		"record_labels": map[string]interface{}{"env": "prod"}}, obj)
+	obj = nil
+	require.NoError(t, json.Unmarshal(lines[3], &obj))
+	require.Equal(t, map[string]interface{}{"record_ts": "2021-03-04T05:06:07.123456Z"}, obj)
+	require.Equal(t, "plain", string(lines[4]))
+
+	// invalid batch is not written
+	out.Reset()
+	_, err = rw.Write([]byte("raw data\n"))
+	require.Error(t, err)
+	require.Empty(t, out.Bytes())
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reasons a file is deleted by retention.
+const (
+	ReasonMaxAge        = "max_age"
+	ReasonMaxBytes      = "max_bytes"
+	ReasonMaxTotalBytes = "max_total_bytes"
+	ReasonDiskWatermark = "disk_watermark"
+)
+
+// RetentionPolicy limits rotated files kept for a stream, zero fields inherit the default.
+type RetentionPolicy struct {
+	// MaxAge deletes files last written longer ago.
+	MaxAge Duration `json:"max_age,omitempty"`
+	// MaxBytes is max total size of files of a stream.
+	MaxBytes uint64 `json:"max_bytes,omitempty"`
+}
+
+// merge returns p with zero fields taken from def.
+func (p RetentionPolicy) merge(def RetentionPolicy) RetentionPolicy {
+	if p.MaxAge == 0 {
+		p.MaxAge = def.MaxAge
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = def.MaxBytes
+	}
+	return p
+}
+
+// Deletion is a file deleted, or would be in dry run, by retention.
+type Deletion struct {
+	Time   time.Time `json:"ts"`
+	Path   string    `json:"path"`
+	Stream string    `json:"stream"`
+	Size   int64     `json:"size"`
+	Reason string    `json:"reason"`
+	DryRun bool      `json:"dry_run,omitempty"`
+}
+
+// Retention deletes rotated files of WriterMan, oldest first, when they are older than max age,
+// when a stream has more than its max bytes or when base dir has more than max total bytes.
+// Log files which are not rotated yet are never deleted, whether they are open or not.
+type Retention struct {
+	wm       *WriterMan
+	l        *zap.SugaredLogger
+	policyFn func(name string) RetentionPolicy
+	maxTotal uint64
+	dryRun   bool
+	audit    io.Writer
+}
+
+// RetentionOption configures optional features of Retention.
+type RetentionOption func(*Retention)
+
+// WithRetentionPolicy sets retention policy of each stream name.
+func WithRetentionPolicy(fn func(name string) RetentionPolicy) RetentionOption {
+	return func(r *Retention) {
+		r.policyFn = fn
+	}
+}
+
+// WithMaxTotalBytes limits total size of files in base dir.
+func WithMaxTotalBytes(n uint64) RetentionOption {
+	return func(r *Retention) {
+		r.maxTotal = n
+	}
+}
+
+// WithDryRun only logs files which would be deleted.
+func WithDryRun() RetentionOption {
+	return func(r *Retention) {
+		r.dryRun = true
+	}
+}
+
+// WithAuditLog writes each deletion to w as a json line.
+func WithAuditLog(w io.Writer) RetentionOption {
+	return func(r *Retention) {
+		r.audit = w
+	}
+}
+
+func NewRetention(wm *WriterMan, opts ...RetentionOption) *Retention {
+	r := &Retention{wm: wm, l: zap.S()}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start runs retention every interval in background.
+func (r *Retention) Start(interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for now := range t.C {
+			if _, err := r.Run(now); err != nil {
+				r.l.Errorw("retention failed", "err", err)
+			}
+		}
+	}()
+}
+
+func (r *Retention) policy(name string) RetentionPolicy {
+	if r.policyFn == nil {
+		return RetentionPolicy{}
+	}
+	return r.policyFn(name)
+}
+
+// logFile is a file in base dir, name is empty if it's not a log file of a stream.
+type logFile struct {
+	path      string
+	name      string
+	size      int64
+	modTime   time.Time
+	deletable bool
+	deleted   bool
+}
+
+// Run deletes files exceeding limits at now once and returns deletions.
+func (r *Retention) Run(now time.Time) ([]Deletion, error) {
+	files, err := r.scan()
+	if err != nil {
+		return nil, err
+	}
+	var res []Deletion
+	del := func(f *logFile, reason string) {
+		if d, ok := r.delete(f, reason, now); ok {
+			res = append(res, d)
+		}
+	}
+
+	streams := make(map[string][]*logFile)
+	for _, f := range files {
+		if f.name == "" {
+			continue
+		}
+		streams[f.name] = append(streams[f.name], f)
+	}
+	for name, sf := range streams {
+		p := r.policy(name)
+		var total uint64
+		for _, f := range sf {
+			if f.deletable && p.MaxAge > 0 && now.Sub(f.modTime) > time.Duration(p.MaxAge) {
+				del(f, ReasonMaxAge)
+			}
+			if !f.deleted {
+				total += uint64(f.size)
+			}
+		}
+		if p.MaxBytes > 0 && total > p.MaxBytes {
+			res = append(res, r.deleteOldest(sf, total-p.MaxBytes, ReasonMaxBytes, now)...)
+		}
+	}
+
+	if r.maxTotal > 0 {
+		var total uint64
+		for _, f := range files {
+			if !f.deleted {
+				total += uint64(f.size)
+			}
+		}
+		if total > r.maxTotal {
+			res = append(res, r.deleteOldest(files, total-r.maxTotal, ReasonMaxTotalBytes, now)...)
+		}
+	}
+	return res, nil
+}
+
+// Free deletes oldest deletable files of any stream until n bytes are deleted, it is used when
+// disk is low on space.
+func (r *Retention) Free(n uint64, now time.Time) ([]Deletion, error) {
+	files, err := r.scan()
+	if err != nil {
+		return nil, err
+	}
+	return r.deleteOldest(files, n, ReasonDiskWatermark, now), nil
+}
+
+// deleteOldest deletes files in order until n bytes are deleted.
+func (r *Retention) deleteOldest(files []*logFile, n uint64, reason string, now time.Time) []Deletion {
+	var (
+		res     []Deletion
+		deleted uint64
+	)
+	for _, f := range files {
+		if deleted >= n {
+			break
+		}
+		if !f.deletable || f.deleted {
+			continue
+		}
+		if d, ok := r.delete(f, reason, now); ok {
+			res = append(res, d)
+			deleted += uint64(f.size)
+		}
+	}
+	return res
+}
+
+// scan lists files in base dir oldest first, only rotated files are deletable. Log files which
+// are not open still receive writes when their stream writes again, so they are kept.
+func (r *Retention) scan() ([]*logFile, error) {
+	m := r.wm.layout.matcher()
+	var files []*logFile
+	err := filepath.Walk(r.wm.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f := &logFile{path: path, size: info.Size(), modTime: info.ModTime()}
+		files = append(files, f)
+		rel, err := filepath.Rel(r.wm.baseDir, path)
+		if err != nil || strings.HasSuffix(path, tmpSuffix) {
+			return nil
+		}
+		name, backup, ok := m.match(filepath.ToSlash(rel), ".gz", ".zst")
+		if ok {
+			f.name = name
+			f.deletable = backup
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, err
+}
+
+// delete removes f unless in dry run and writes audit log, it returns false if removing failed.
+func (r *Retention) delete(f *logFile, reason string, now time.Time) (Deletion, bool) {
+	d := Deletion{Time: now, Path: f.path, Stream: f.name, Size: f.size, Reason: reason, DryRun: r.dryRun}
+	if !r.dryRun {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			r.l.Errorw("retention failed to delete file", "file", f.path, "reason", reason, "err", err)
+			return d, false
+		}
+	}
+	f.deleted = true
+	if !r.dryRun {
+		retentionDeleted.Add(1)
+		retentionDeletedSize.Add(f.size)
+	}
+	if r.audit != nil {
+		data, _ := json.Marshal(d)
+		if _, err := r.audit.Write(append(data, '\n')); err != nil {
+			r.l.Errorw("write retention audit log failed", "file", f.path, "err", err)
+		}
+	}
+	return d, true
+}
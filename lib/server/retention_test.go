@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutMatcher(t *testing.T) {
+	l, err := NewLayout("", "")
+	require.NoError(t, err)
+	m := l.matcher()
+	for path, want := range map[string]struct {
+		name   string
+		backup bool
+	}{
+		"app/app.log": {"app", false},
+		"app/app-20210203_040506-20210203_235959.log":        {"app", true},
+		"app/app-20210203_040506-20210203_235959.1.log":      {"app", true},
+		"app/app-20210203_040506-20210203_235959.log.gz":     {"app", true},
+		"app/app-20210203_040506-20210203_235959.12.log.zst": {"app", true},
+	} {
+		name, backup, ok := m.match(path, ".gz", ".zst")
+		require.True(t, ok, path)
+		require.Equal(t, want.name, name, path)
+		require.Equal(t, want.backup, backup, path)
+	}
+	for _, path := range []string{"app.log", "app/other.txt", "app/app-2021.log", "a/b/app.log"} {
+		_, _, ok := m.match(path, ".gz")
+		require.False(t, ok, path)
+	}
+
+	l, err = NewLayout("{host}/{yyyy}{mm}{dd}/{name}-{label.pod}.log", "{base}.{hh}{mi}{ext}")
+	require.NoError(t, err)
+	m = l.matcher()
+	name, backup, ok := m.match("web-1/20210203/app-x-a.0405.log")
+	require.True(t, ok)
+	require.True(t, backup)
+	require.Equal(t, "app-x", name)
+	name, backup, ok = m.match("web-1/20210203/app-a.log")
+	require.True(t, ok)
+	require.False(t, backup)
+	require.Equal(t, "app", name)
+}
+
+func writeFile(t *testing.T, path string, size int, modTime time.Time) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, make([]byte, size), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	var res []string
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			res = append(res, filepath.ToSlash(rel))
+		}
+		return err
+	}))
+	sort.Strings(res)
+	return res
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWriterMan(dir, 1<<30)
+	now := time.Now()
+	day := 24 * time.Hour
+	writeFile(t, filepath.Join(dir, "a/a-20210101_000000-20210101_235959.log"), 100, now.Add(-3*day))
+	writeFile(t, filepath.Join(dir, "a/a-20210102_000000-20210102_235959.log.gz"), 100, now.Add(-2*day))
+	writeFile(t, filepath.Join(dir, "a/a-20210103_000000-20210103_235959.log"), 100, now.Add(-day))
+	writeFile(t, filepath.Join(dir, "b/b-20210101_000000-20210101_235959.log"), 100, now.Add(-3*day))
+	writeFile(t, filepath.Join(dir, "b/b-20210102_000000-20210102_235959.log"), 100, now.Add(-2*day))
+	writeFile(t, filepath.Join(dir, "notes.txt"), 100, now.Add(-10*day))
+	// log file which is not rotated yet is never deleted, even if it is not open
+	writeFile(t, filepath.Join(dir, "b/b.log"), 100, now.Add(-10*day))
+	// open file is never deleted
+	w := wm.GetOrCreate("a")
+	_, err := w.Write(make([]byte, 100))
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "a/a.log"), now.Add(-10*day), now.Add(-10*day)))
+
+	var audit bytes.Buffer
+	policy := func(name string) RetentionPolicy {
+		if name == "a" {
+			return RetentionPolicy{MaxBytes: 250}
+		}
+		return RetentionPolicy{MaxAge: Duration(day + time.Hour)}
+	}
+	all := listFiles(t, dir)
+
+	// dry run deletes nothing
+	r := NewRetention(wm, WithRetentionPolicy(policy), WithDryRun(), WithAuditLog(&audit))
+	res, err := r.Run(now)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	require.Equal(t, all, listFiles(t, dir))
+
+	audit.Reset()
+	r = NewRetention(wm, WithRetentionPolicy(policy), WithAuditLog(&audit))
+	res, err = r.Run(now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/a-20210103_000000-20210103_235959.log", "a/a.log", "b/b.log", "notes.txt"},
+		listFiles(t, dir))
+	reasons := make(map[string]string)
+	for _, d := range res {
+		rel, _ := filepath.Rel(dir, d.Path)
+		reasons[filepath.ToSlash(rel)] = d.Reason
+	}
+	require.Equal(t, map[string]string{
+		"a/a-20210101_000000-20210101_235959.log":    ReasonMaxBytes,
+		"a/a-20210102_000000-20210102_235959.log.gz": ReasonMaxBytes,
+		"b/b-20210101_000000-20210101_235959.log":    ReasonMaxAge,
+		"b/b-20210102_000000-20210102_235959.log":    ReasonMaxAge,
+	}, reasons)
+	lines := bytes.Split(bytes.TrimSpace(audit.Bytes()), []byte("\n"))
+	require.Len(t, lines, 4)
+	var d Deletion
+	require.NoError(t, json.Unmarshal(lines[0], &d))
+	require.Equal(t, int64(100), d.Size)
+
+	// total limit deletes oldest deletable files of any stream
+	r = NewRetention(wm, WithMaxTotalBytes(250))
+	res, err = r.Run(now)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, ReasonMaxTotalBytes, res[0].Reason)
+	require.Equal(t, []string{"a/a.log", "b/b.log", "notes.txt"}, listFiles(t, dir))
+	require.NoError(t, w.Close())
+}
+
+func TestRetentionDatedLayout(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLayout("{name}/{yyyy}{mm}{dd}/{name}.log", "")
+	require.NoError(t, err)
+	wm := NewWriterMan(dir, 1<<30, WithLayout(l))
+	now := time.Now()
+	day := 24 * time.Hour
+	w := wm.GetOrCreate("a")
+	_, err = w.Write([]byte("day 1\n"))
+	require.NoError(t, err)
+	old := w.current()
+	// next write goes to the file of next day, the old one is rotated
+	pathFn := w.pathFn
+	w.pathFn = func(t time.Time) string {
+		return pathFn(t.Add(day))
+	}
+	_, err = w.Write([]byte("day 2\n"))
+	require.NoError(t, err)
+	_, err = os.Stat(old)
+	require.True(t, os.IsNotExist(err))
+	files := listFiles(t, dir)
+	require.Len(t, files, 2)
+	for _, f := range files {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, f), now.Add(-3*day), now.Add(-3*day)))
+	}
+
+	r := NewRetention(wm, WithRetentionPolicy(func(string) RetentionPolicy {
+		return RetentionPolicy{MaxAge: Duration(day)}
+	}))
+	res, err := r.Run(now)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, filepath.Dir(old), filepath.Dir(res[0].Path))
+	rel, err := filepath.Rel(dir, w.current())
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.ToSlash(rel)}, listFiles(t, dir))
+	require.NoError(t, w.Close())
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// ScheduleNone disables scheduled rotation of a stream.
+	ScheduleNone = "none"
+	// DefaultSchedule rotates at midnight.
+	DefaultSchedule = "@daily"
+
+	rotateCheckInterval = time.Second
+)
+
+// Duration is a time.Duration which is written as a string like "1h30m" in json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// RotationPolicy decides when current file of a stream is rotated, zero fields inherit the
+// default policy.
+type RotationPolicy struct {
+	// Schedule is a cron spec like "0 * * * *" or a descriptor like @hourly, ScheduleNone disables it.
+	Schedule string `json:"schedule,omitempty"`
+	// MaxSize is max bytes of a file.
+	MaxSize uint64 `json:"max_size,omitempty"`
+	// MaxLines is max lines written to a file since it was opened.
+	MaxLines uint64 `json:"max_lines,omitempty"`
+	// MaxAge is max time since a file was opened.
+	MaxAge Duration `json:"max_age,omitempty"`
+	// Idle rotates a file which was not written for this duration.
+	Idle Duration `json:"idle,omitempty"`
+}
+
+// Validate checks schedule and durations of policy.
+func (p RotationPolicy) Validate() error {
+	if p.MaxAge < 0 || p.Idle < 0 {
+		return fmt.Errorf("rotation max age and idle must not be negative")
+	}
+	if p.Schedule == "" || p.Schedule == ScheduleNone {
+		return nil
+	}
+	if _, err := cron.ParseStandard(p.Schedule); err != nil {
+		return fmt.Errorf("invalid rotation schedule %s, %w", p.Schedule, err)
+	}
+	return nil
+}
+
+// merge returns p with zero fields taken from def.
+func (p RotationPolicy) merge(def RotationPolicy) RotationPolicy {
+	if p.Schedule == "" {
+		p.Schedule = def.Schedule
+	}
+	if p.MaxSize == 0 {
+		p.MaxSize = def.MaxSize
+	}
+	if p.MaxLines == 0 {
+		p.MaxLines = def.MaxLines
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = def.MaxAge
+	}
+	if p.Idle == 0 {
+		p.Idle = def.Idle
+	}
+	return p
+}
+
+// scheduled returns the schedule spec, or empty if scheduled rotation is disabled.
+func (p RotationPolicy) scheduled() string {
+	if p.Schedule == ScheduleNone {
+		return ""
+	}
+	return p.Schedule
+}
+
+// exceeded reports whether a file with stats is due to rotate by size or lines.
+func (p RotationPolicy) exceeded(size, lines uint64) bool {
+	return (p.MaxSize > 0 && size >= p.MaxSize) || (p.MaxLines > 0 && lines >= p.MaxLines)
+}
+
+// expired reports whether a file opened at openedAt and last written at lastWrite is due to
+// rotate at now.
+func (p RotationPolicy) expired(openedAt, lastWrite, now time.Time) bool {
+	return (p.MaxAge > 0 && now.Sub(openedAt) >= time.Duration(p.MaxAge)) ||
+		(p.Idle > 0 && now.Sub(lastWrite) >= time.Duration(p.Idle))
+}
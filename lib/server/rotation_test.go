@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func backupCount(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	require.NoError(t, err)
+	return len(files)
+}
+
+func TestRotateMaxLines(t *testing.T) {
+	dir := t.TempDir()
+	seq := 0
+	w := newRotateLogWriter(RotationPolicy{MaxLines: 2}, func(time.Time) string {
+		return filepath.Join(dir, "app.log")
+	}, func(current string, _, _ time.Time) string {
+		seq++
+		return filepath.Join(dir, fmt.Sprintf("app-%d.log", seq))
+	})
+	_, err := w.Write([]byte("a\n"))
+	require.NoError(t, err)
+	require.Equal(t, 0, backupCount(t, dir))
+	_, err = w.Write([]byte("b\nc\n"))
+	require.NoError(t, err)
+	require.Equal(t, 1, backupCount(t, dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app-1.log"))
+	require.NoError(t, err)
+	require.Equal(t, "a\nb\nc\n", string(data))
+}
+
+func TestRotateIdle(t *testing.T) {
+	dir := t.TempDir()
+	w := newRotateLogWriter(RotationPolicy{Idle: Duration(time.Minute)}, func(time.Time) string {
+		return filepath.Join(dir, "app.log")
+	}, func(current string, _, _ time.Time) string {
+		return filepath.Join(dir, "app-1.log")
+	})
+	// nothing to rotate before first write
+	require.NoError(t, w.rotateIfExpired(time.Now().Add(time.Hour)))
+	_, err := w.Write([]byte("a\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.rotateIfExpired(time.Now()))
+	require.Equal(t, 0, backupCount(t, dir))
+	require.NoError(t, w.rotateIfExpired(time.Now().Add(time.Minute)))
+	require.Equal(t, 1, backupCount(t, dir))
+}
+
+func TestRotationPolicy(t *testing.T) {
+	var p RotationPolicy
+	require.NoError(t, json.Unmarshal([]byte(`{"schedule": "@hourly", "max_lines": 10, "idle": "5m"}`), &p))
+	require.Equal(t, RotationPolicy{Schedule: "@hourly", MaxLines: 10, Idle: Duration(5 * time.Minute)}, p)
+	require.NoError(t, p.Validate())
+
+	p = p.merge(RotationPolicy{Schedule: DefaultSchedule, MaxSize: 100, Idle: Duration(time.Hour)})
+	require.Equal(t, RotationPolicy{Schedule: "@hourly", MaxSize: 100, MaxLines: 10, Idle: Duration(5 * time.Minute)}, p)
+	require.True(t, p.exceeded(100, 0))
+	require.True(t, p.exceeded(0, 10))
+	require.False(t, p.exceeded(99, 9))
+
+	require.Equal(t, "", RotationPolicy{Schedule: ScheduleNone}.scheduled())
+	require.NoError(t, RotationPolicy{Schedule: "0 */6 * * *"}.Validate())
+	require.Error(t, RotationPolicy{Schedule: "every hour"}.Validate())
+	require.Error(t, RotationPolicy{Idle: Duration(-time.Second)}.Validate())
+}
+
+func TestWriterManRotation(t *testing.T) {
+	wm := NewWriterMan(t.TempDir(), 1<<30, WithRotation(func(name string) RotationPolicy {
+		if name == "hourly" {
+			return RotationPolicy{Schedule: "@hourly", MaxLines: 5}
+		}
+		return RotationPolicy{}
+	}))
+	require.Equal(t, RotationPolicy{Schedule: "@hourly", MaxSize: 1 << 30, MaxLines: 5}, wm.GetOrCreate("hourly").policy)
+	require.Equal(t, RotationPolicy{Schedule: DefaultSchedule, MaxSize: 1 << 30}, wm.GetOrCreate("other").policy)
+	require.True(t, wm.schedules["@hourly"])
+	require.True(t, wm.schedules[DefaultSchedule])
+}
+
+func TestRotateBackupRange(t *testing.T) {
+	dir := t.TempDir()
+	var first, last []time.Time
+	w := newRotateLogWriter(RotationPolicy{MaxLines: 1}, func(time.Time) string {
+		return filepath.Join(dir, "app.log")
+	}, func(current string, f, l time.Time) string {
+		first, last = append(first, f), append(last, l)
+		return filepath.Join(dir, "app-range.log")
+	})
+	before := time.Now()
+	_, err := w.Write([]byte("a"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = w.Write([]byte("b\n"))
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.True(t, !first[0].Before(before) && last[0].Sub(first[0]) >= 10*time.Millisecond)
+
+	// backups with the same range are numbered
+	_, err = w.Write([]byte("c\n"))
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app-range.1.log"))
+	require.NoError(t, err)
+	require.Equal(t, "c\n", string(data))
+}
@@ -1,47 +1,203 @@
 package server
 
 import (
+	"crypto/tls"
 	"net"
+	"sync"
 
 	"go.uber.org/zap"
+
+	"github.com/KyberNetwork/cclog/lib/common"
 )
 
 type Server struct {
+	// connSeq is the id of the last accepted connection, first field for 64-bit atomic alignment.
+	connSeq  uint64
 	wm       *WriterMan
+	sm       *SessionMan
 	bindAddr string
 	l        *zap.SugaredLogger
 	listener net.Listener
+	// tlsConfig enables TLS on listener, restrictNames limits stream names a client can write
+	// to the names in its certificate.
+	tlsConfig     *tls.Config
+	restrictNames bool
+	// acl requires clients to present a token allowed to write to the stream name.
+	acl *ACL
+	// maxLineLength is the longest line kept whole, longer lines are split.
+	maxLineLength int
+	// streams holds per stream settings like enrichment.
+	streams *StreamConfig
+	// disk rejects clients and holds writes when base dir is full, nil if not monitored.
+	disk *DiskMonitor
+	// conns are connections which finished handshake, by id.
+	connLock sync.Mutex
+	conns    map[uint64]ConnectionInfo
+	// handlers are running client handlers, guarded by connLock. Once stopping is set no handler
+	// is added, stopped is closed then to stop handlers waiting for disk space.
+	handlers     map[*ClientHandler]struct{}
+	handlersDone sync.WaitGroup
+	stopping     bool
+	stopped      chan struct{}
 }
 
-func NewServer(bindAddr string, wm *WriterMan) *Server {
-	return &Server{
-		wm:       wm,
-		bindAddr: bindAddr,
-		l:        zap.S(),
+// Option configures optional features of Server.
+type Option func(*Server)
+
+// WithTLS serves clients over TLS, if restrictNames is set a client can only write to stream
+// names matching CN or DNS SANs of its certificate, which can be glob patterns like "trading-*".
+func WithTLS(cfg *tls.Config, restrictNames bool) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+		s.restrictNames = restrictNames
 	}
 }
 
-func (s *Server) Start() error {
+// WithACL requires each client to present a token which is allowed to write to its stream name.
+func WithACL(acl *ACL) Option {
+	return func(s *Server) {
+		s.acl = acl
+	}
+}
+
+// WithMaxLineLength sets the longest line server buffers until its newline arrives, a longer
+// line is split with a newline after n bytes.
+func WithMaxLineLength(n int) Option {
+	return func(s *Server) {
+		s.maxLineLength = n
+	}
+}
+
+// WithStreamConfig sets default and per name stream settings.
+func WithStreamConfig(cfg *StreamConfig) Option {
+	return func(s *Server) {
+		s.streams = cfg
+	}
+}
+
+// WithDiskMonitor rejects new clients and makes connected ones wait while disk is full.
+func WithDiskMonitor(d *DiskMonitor) Option {
+	return func(s *Server) {
+		s.disk = d
+	}
+}
+
+func NewServer(bindAddr string, wm *WriterMan, opts ...Option) *Server {
+	s := &Server{
+		wm:            wm,
+		sm:            NewSessionMan(),
+		bindAddr:      bindAddr,
+		l:             zap.S(),
+		maxLineLength: defaultMaxLineLength,
+		streams:       &StreamConfig{},
+		conns:         make(map[uint64]ConnectionInfo),
+		handlers:      make(map[*ClientHandler]struct{}),
+		stopped:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// capabilities returns protocol capabilities server supports.
+func (s *Server) capabilities() []string {
+	caps := []string{common.CapFraming, common.CapAck, common.CapResume, common.CapRecords}
+	if s.acl != nil {
+		caps = append(caps, common.CapAuth)
+	}
+	return caps
+}
+
+// Listen binds the server address, it is called by Start.
+func (s *Server) Listen() error {
 	var err error
 	s.listener, err = net.Listen("tcp", s.bindAddr)
 	if err != nil {
 		s.l.Errorw("failed to bind address", "err", err)
 		return err
 	}
+	if s.tlsConfig != nil {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
+	return nil
+}
+
+// Addr returns the address server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until listener is closed, Listen must be called first.
+func (s *Server) Serve() error {
 	for {
 		c, err := s.listener.Accept()
 		if err != nil {
 			s.l.Errorw("accept failed", "err", err)
 			return err
 		}
-		cc := NewClientHandler(c, s.wm)
-		go cc.Run()
+		cc := NewClientHandler(c, s)
+		if !s.addHandler(cc) {
+			_ = c.Close()
+			continue
+		}
+		go func() {
+			defer s.removeHandler(cc)
+			cc.Run()
+		}()
+	}
+}
+
+// addHandler registers cc as running, it returns false if server is shutting down.
+func (s *Server) addHandler(cc *ClientHandler) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.stopping {
+		return false
+	}
+	s.handlers[cc] = struct{}{}
+	s.handlersDone.Add(1)
+	return true
+}
+
+func (s *Server) removeHandler(cc *ClientHandler) {
+	s.connLock.Lock()
+	delete(s.handlers, cc)
+	s.connLock.Unlock()
+	s.handlersDone.Done()
+}
+
+func (s *Server) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
 	}
+	return s.Serve()
 }
 
+// Shutdown stops accepting clients, closes connections of running handlers and waits for them
+// to return, so their data is written to writers of WriterMan when it returns. Clients resend
+// data which was not acknowledged to another server or after restart.
 func (s *Server) Shutdown() error {
+	s.connLock.Lock()
+	first := !s.stopping
+	s.stopping = true
+	handlers := make([]*ClientHandler, 0, len(s.handlers))
+	for cc := range s.handlers {
+		handlers = append(handlers, cc)
+	}
+	s.connLock.Unlock()
+	if !first {
+		s.handlersDone.Wait()
+		return nil
+	}
+	close(s.stopped)
+	var err error
 	if s.listener != nil {
-		return s.listener.Close()
+		err = s.listener.Close()
 	}
-	return nil
+	for _, cc := range handlers {
+		cc.Stop()
+	}
+	s.handlersDone.Wait()
+	return err
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	sessionIdleTimeout = time.Hour
+	sessionSweepEvery  = time.Minute
+	// maxSessions caps sessions kept, so clients reconnecting with new ids can't grow them
+	// without limit, the least recently seen session is removed when it is reached.
+	maxSessions = 100000
+)
+
+// session keeps the last sequence written for a client session, so a reconnected client
+// can resume from there and replayed frames can be dropped.
+type session struct {
+	lock     sync.Mutex
+	lastSeq  uint64
+	lastSeen time.Time
+}
+
+// SessionMan holds sessions of all streams, idle sessions are removed after sessionIdleTimeout
+// and at most max sessions are kept.
+type SessionMan struct {
+	lock      sync.Mutex
+	sessions  map[string]*session
+	lastSweep time.Time
+	max       int
+}
+
+func NewSessionMan() *SessionMan {
+	return &SessionMan{
+		sessions:  make(map[string]*session),
+		lastSweep: time.Now(),
+		max:       maxSessions,
+	}
+}
+
+// getOrCreate returns session of id for stream name, a new session starts after lastAck
+// which is the last sequence client knows server has written.
+func (m *SessionMan) getOrCreate(name, id string, lastAck uint64) *session {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastSweep) > sessionSweepEvery {
+		m.sweep(now)
+	}
+	key := name + "/" + id
+	s, ok := m.sessions[key]
+	if !ok {
+		if len(m.sessions) >= m.max {
+			m.sweep(now)
+		}
+		if len(m.sessions) >= m.max {
+			m.removeOldest()
+		}
+		s = &session{lastSeq: lastAck}
+		m.sessions[key] = s
+	}
+	s.lock.Lock()
+	s.lastSeen = now
+	s.lock.Unlock()
+	return s
+}
+
+// have to call from func that keep lock object
+func (m *SessionMan) sweep(now time.Time) {
+	m.lastSweep = now
+	for k, s := range m.sessions {
+		s.lock.Lock()
+		idle := now.Sub(s.lastSeen) > sessionIdleTimeout
+		s.lock.Unlock()
+		if idle {
+			delete(m.sessions, k)
+		}
+	}
+}
+
+// removeOldest removes the least recently seen session, have to call with lock held.
+func (m *SessionMan) removeOldest() {
+	var (
+		oldestKey  string
+		oldestSeen time.Time
+	)
+	for k, s := range m.sessions {
+		s.lock.Lock()
+		seen := s.lastSeen
+		s.lock.Unlock()
+		if oldestKey == "" || seen.Before(oldestSeen) {
+			oldestKey, oldestSeen = k, seen
+		}
+	}
+	delete(m.sessions, oldestKey)
+}
+
+// resumeFrom returns the next sequence session expects.
+func (s *session) resumeFrom() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastSeq + 1
+}
+
+// write writes data of frame seq to w unless it was written before, it returns the last
+// sequence written of session. Replayed frame is reported as fully written.
+func (s *session) write(w io.Writer, seq uint64, data []byte) (uint64, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastSeen = time.Now()
+	if seq <= s.lastSeq {
+		return s.lastSeq, len(data), nil
+	}
+	n, err := w.Write(data)
+	if err == nil && n == len(data) {
+		s.lastSeq = seq
+	}
+	return s.lastSeq, n, err
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
+)
+
+func connectSession(t *testing.T, addr string, lastAck uint64) (net.Conn, common.ConnectResponse) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, common.WriteConnectRequest(conn, common.ConnectRequest{
+		Name:         "test",
+		Version:      common.ProtocolVersion,
+		Capabilities: []string{common.CapFraming, common.CapAck, common.CapResume},
+		SessionID:    "s1",
+		LastAck:      lastAck,
+	}))
+	resp, err := common.ReadConnectResponse(conn)
+	require.NoError(t, err)
+	require.True(t, resp.Success)
+	return conn, resp
+}
+
+func waitAck(t *testing.T, conn net.Conn, seq uint64) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := common.ReadFrame(conn, nil)
+		require.NoError(t, err)
+		require.Equal(t, common.FrameAck, f.Type)
+		if f.Seq == seq {
+			return
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	baseDir := t.TempDir()
+	srv := startTestServer(t, baseDir)
+	conn, resp := connectSession(t, srv.Addr().String(), 0)
+	require.Equal(t, uint64(1), resp.ResumeFrom)
+	require.NoError(t, common.WriteDataFrame(conn, 1, []byte("1\n")))
+	require.NoError(t, common.WriteDataFrame(conn, 2, []byte("2\n")))
+	waitAck(t, conn, 2)
+	_ = conn.Close()
+
+	// client only knows seq 1 was acknowledged and replays from there
+	conn, resp = connectSession(t, srv.Addr().String(), 1)
+	require.Equal(t, uint64(3), resp.ResumeFrom)
+	require.NoError(t, common.WriteDataFrame(conn, 2, []byte("2\n")))
+	require.NoError(t, common.WriteDataFrame(conn, 3, []byte("3\n")))
+	waitAck(t, conn, 3)
+	_ = conn.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "1\n2\n3\n", string(data))
+}
+
+func TestSessionLimit(t *testing.T) {
+	m := NewSessionMan()
+	m.max = 2
+	m.getOrCreate("test", "s1", 0)
+	time.Sleep(time.Millisecond)
+	m.getOrCreate("test", "s2", 0)
+	time.Sleep(time.Millisecond)
+	m.getOrCreate("test", "s1", 0)
+	// s2 is the least recently seen one
+	m.getOrCreate("test", "s3", 5)
+	require.Len(t, m.sessions, 2)
+	require.Contains(t, m.sessions, "test/s1")
+	require.Contains(t, m.sessions, "test/s3")
+	require.Equal(t, uint64(6), m.getOrCreate("test", "s3", 0).resumeFrom())
+}
+
+func TestAckCompleteLines(t *testing.T) {
+	baseDir := t.TempDir()
+	srv := startTestServer(t, baseDir)
+	conn, _ := connectSession(t, srv.Addr().String(), 0)
+	defer conn.Close()
+	require.NoError(t, common.WriteDataFrame(conn, 1, []byte("1\n")))
+	waitAck(t, conn, 1)
+
+	// frame 2 ends in an incomplete line, it isn't acknowledged until the line is written
+	require.NoError(t, common.WriteDataFrame(conn, 2, []byte("2\npart")))
+	_ = conn.SetReadDeadline(time.Now().Add(3 * ackInterval))
+	_, err := common.ReadFrame(conn, nil)
+	require.Error(t, err)
+	require.NoError(t, common.WriteDataFrame(conn, 3, []byte("ial")))
+	require.NoError(t, common.WriteDataFrame(conn, 4, []byte("\n3\n")))
+	waitAck(t, conn, 4)
+}
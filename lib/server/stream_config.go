@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// StreamSettings configures how server handles a stream, empty fields inherit the default.
+type StreamSettings struct {
+	Enrich    EnrichMode      `json:"enrich,omitempty"`
+	Rotation  RotationPolicy  `json:"rotation,omitempty"`
+	Retention RetentionPolicy `json:"retention,omitempty"`
+	Sync      SyncPolicy      `json:"sync,omitempty"`
+}
+
+// StreamRule applies its settings to streams with name matching one of Names glob patterns.
+type StreamRule struct {
+	Names []string `json:"names"`
+	StreamSettings
+}
+
+// StreamConfig holds default stream settings and per name overrides, the first matching rule
+// applies.
+type StreamConfig struct {
+	Default StreamSettings `json:"default"`
+	Streams []StreamRule   `json:"streams"`
+}
+
+// LoadStreamConfig reads stream config from a json file, like
+// {"default": {"enrich": "prefix"}, "streams": [{"names": ["trading-*"], "enrich": "none",
+// "rotation": {"schedule": "@hourly", "max_lines": 1000000}}]}
+func LoadStreamConfig(file string) (*StreamConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg StreamConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse stream config failed, %w", err)
+	}
+	if err = cfg.Default.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid default settings, %w", err)
+	}
+	for i, r := range cfg.Streams {
+		for _, p := range r.Names {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("stream rule %d has invalid name pattern %s", i, p)
+			}
+		}
+		if err = r.Validate(); err != nil {
+			return nil, fmt.Errorf("stream rule %d is invalid, %w", i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// Validate checks values of settings.
+func (s StreamSettings) Validate() error {
+	switch s.Enrich {
+	case "", EnrichNone, EnrichPrefix, EnrichWrap:
+	default:
+		return fmt.Errorf("unknown enrich mode %s", s.Enrich)
+	}
+	if s.Retention.MaxAge < 0 {
+		return fmt.Errorf("retention max age must not be negative")
+	}
+	if err := s.Sync.Validate(); err != nil {
+		return err
+	}
+	return s.Rotation.Validate()
+}
+
+// merge returns s with empty fields taken from def.
+func (s StreamSettings) merge(def StreamSettings) StreamSettings {
+	if s.Enrich == "" {
+		s.Enrich = def.Enrich
+	}
+	s.Rotation = s.Rotation.merge(def.Rotation)
+	s.Retention = s.Retention.merge(def.Retention)
+	s.Sync = s.Sync.merge(def.Sync)
+	return s
+}
+
+// Settings returns settings of stream name.
+func (c *StreamConfig) Settings(name string) StreamSettings {
+	for _, r := range c.Streams {
+		for _, p := range r.Names {
+			if ok, _ := path.Match(p, name); ok {
+				return r.StreamSettings.merge(c.Default)
+			}
+		}
+	}
+	return c.Default
+}
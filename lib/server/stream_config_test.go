@@ -0,0 +1,32 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "streams.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{
+		"default": {"enrich": "prefix"},
+		"streams": [{"names": ["trading-*"], "enrich": "wrap", "rotation": {"schedule": "@hourly"}}, {"names": ["audit"]}]
+	}`), 0600))
+	cfg, err := LoadStreamConfig(file)
+	require.NoError(t, err)
+	require.Equal(t, EnrichWrap, cfg.Settings("trading-a").Enrich)
+	// empty fields inherit default
+	require.Equal(t, EnrichPrefix, cfg.Settings("audit").Enrich)
+	require.Equal(t, EnrichPrefix, cfg.Settings("other").Enrich)
+	require.Equal(t, "@hourly", cfg.Settings("trading-a").Rotation.Schedule)
+	require.Equal(t, "", cfg.Settings("audit").Rotation.Schedule)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"streams": [{"names": ["a"], "enrich": "xml"}]}`), 0600))
+	_, err = LoadStreamConfig(file)
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"default": {"rotation": {"schedule": "hourly"}}}`), 0600))
+	_, err = LoadStreamConfig(file)
+	require.Error(t, err)
+}
@@ -1,36 +1,85 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
+// errBufferNotWritten is returned when buffered data can't be written because no file is open,
+// like after closing the file failed to write it. The data is written to the next file opened.
+var errBufferNotWritten = errors.New("buffered data is not written, no file is open")
+
 type RotateLogWriter struct {
+	l               *zap.SugaredLogger
 	currentFile     *os.File
 	currentFileName string
 	lock            sync.Mutex
-	baseDir         string
-	name            string
-	maxSize         uint64
+	policy          RotationPolicy
 	currentWrite    uint64
+	// currentLines is lines written to current file since it was opened, openedAt is when it
+	// was opened, firstWrite and lastWrite are the time range its content covers.
+	currentLines uint64
+	openedAt     time.Time
+	firstWrite   time.Time
+	lastWrite    time.Time
+	// pathFn returns path of the file to write at a time, backupFn returns name a file is
+	// renamed to when it is rotated, by the time of its first and last write.
+	pathFn   func(time.Time) string
+	backupFn func(current string, first, last time.Time) string
+	// compressor compresses rotated files if set.
+	compressor *Compressor
+	// sync is when data is fsynced, unsynced is bytes written since last fsync and
+	// syncScheduled is set while a timed fsync is pending.
+	sync          SyncPolicy
+	unsynced      uint64
+	syncScheduled bool
+	// buffer holds data not written to current file yet in buffered mode, which is on if
+	// bufferSize > 0. A flusher goroutine writes it every flushInterval while it has data.
+	buffer         []byte
+	bufferSize     int
+	flushInterval  time.Duration
+	flusherRunning bool
+	// refs is the number of connections using the writer and lastUsed is when it was last
+	// acquired or released, both are guarded by lock of WriterMan.
+	refs     int
+	lastUsed time.Time
 }
 
 func NewRotateLogWriter(baseDir string, name string, maxSize uint64) *RotateLogWriter {
 	_ = os.MkdirAll(baseDir, 0755) // make sure dir is exists
+	fileName := path.Join(baseDir, name)
+	return newRotateLogWriter(RotationPolicy{MaxSize: maxSize}, func(time.Time) string {
+		return fileName
+	}, func(current string, first, _ time.Time) string {
+		ext := filepath.Ext(current)
+		return current[:len(current)-len(ext)] + "-" + first.UTC().Format("20060102_150405") + ext
+	})
+}
+
+func newRotateLogWriter(policy RotationPolicy, pathFn func(time.Time) string,
+	backupFn func(string, time.Time, time.Time) string) *RotateLogWriter {
 	return &RotateLogWriter{
-		baseDir:      baseDir,
-		name:         name,
-		maxSize:      maxSize,
+		l:            zap.S(),
+		policy:       policy,
 		currentWrite: 0,
+		pathFn:       pathFn,
+		backupFn:     backupFn,
 	}
 }
 
-func (r *RotateLogWriter) createOrOpenFile() (*os.File, string, uint64, error) {
-	currentFileName := path.Join(r.baseDir, r.name)
+func (r *RotateLogWriter) createOrOpenFile(currentFileName string) (*os.File, string, uint64, error) {
+	if err := os.MkdirAll(filepath.Dir(currentFileName), 0755); err != nil {
+		return nil, "", 0, err
+	}
 	currentFile, err := os.OpenFile(currentFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, "", 0, err
@@ -40,79 +89,286 @@ func (r *RotateLogWriter) createOrOpenFile() (*os.File, string, uint64, error) {
 		return nil, "", 0, err
 	}
 	currentWrite := uint64(ss.Size())
+	if currentWrite > 0 && (r.firstWrite.IsZero() || currentFileName != r.currentFileName) {
+		// file was written before server started, its first write is unknown, modify time is
+		// the earliest known one
+		r.firstWrite = ss.ModTime()
+	}
 	return currentFile, currentFileName, currentWrite, nil
 }
 
 func (r *RotateLogWriter) Write(p []byte) (n int, err error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	now := time.Now()
+	fileName := r.pathFn(now)
+	if r.currentFileName != "" && fileName != r.currentFileName {
+		// path has time in it, rotate the old file so retention can delete it and move to the new file
+		if err = r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate failed %w", err)
+		}
+	}
 	if r.currentFile == nil {
-		r.currentFile, r.currentFileName, r.currentWrite, err = r.createOrOpenFile()
+		// file closed while idle is reopened with its lines, age and time range kept
+		reopen := fileName == r.currentFileName
+		f, name, size, err := r.createOrOpenFile(fileName)
 		if err != nil {
 			return 0, err
 		}
+		r.currentFile, r.currentFileName, r.currentWrite = f, name, size
+		if !reopen {
+			r.currentLines = 0
+			r.openedAt = now
+		}
+		if r.currentWrite == 0 {
+			r.firstWrite = now
+			if r.sync.enabled() {
+				// make entry of the new file durable
+				if err = syncDir(filepath.Dir(r.currentFileName)); err != nil {
+					fsyncFailed.Add(1)
+					return 0, err
+				}
+			}
+		}
 	}
-	n, err = r.currentFile.Write(p)
+	n, err = r.writeFile(p)
 	if n < 0 {
 		panic("bytes written negative")
 	}
 	r.currentWrite += uint64(n)
-	if r.currentWrite >= r.maxSize {
+	r.currentLines += uint64(bytes.Count(p[:n], []byte{'\n'}))
+	r.lastWrite = now
+	r.unsynced += uint64(n)
+	if size := r.sync.bytes(); err == nil && size > 0 && r.unsynced >= size {
+		if err = r.syncFile(); err != nil {
+			return n, err
+		}
+	} else if d := r.sync.interval(); d > 0 && !r.syncScheduled {
+		r.syncScheduled = true
+		time.AfterFunc(d, r.syncLater)
+	}
+	if r.policy.exceeded(r.currentWrite, r.currentLines) || r.policy.expired(r.openedAt, now, now) {
 		err = r.rotate()
 		if err != nil {
-			err = fmt.Errorf("dailyRotate failed %w", err)
+			err = fmt.Errorf("rotate failed %w", err)
 		}
 	}
 	return
 }
 
 func (r *RotateLogWriter) rotate() error {
+	if r.currentFileName == "" {
+		// nothing written since last rotate
+		return r.close()
+	}
 	defer func() {
 		r.currentFileName = ""
 	}()
-	ext := filepath.Ext(r.currentFileName)
-	var backupName string
 	err := r.close()
 	if err != nil {
 		return err
 	}
-	for {
-		backupName = r.currentFileName[:len(r.currentFileName)-len(ext)] + "-" +
-			time.Now().Format("20060102_150405") + ext
-		if bs, err := os.Stat(backupName); err == nil && bs.Size() > 0 {
-			time.Sleep(time.Second)
-			continue
+	backupName := r.backupFn(r.currentFileName, r.firstWrite, r.lastWrite)
+	ext := filepath.Ext(backupName)
+	base := strings.TrimSuffix(backupName, ext)
+	for i := 1; ; i++ {
+		// files rotated by size or lines can cover the same range, number them
+		if !r.backupExists(backupName) {
+			break
 		}
-		break
+		backupName = fmt.Sprintf("%s.%d%s", base, i, ext)
 	}
 
 	err = os.Rename(r.currentFileName, backupName)
 	if err != nil {
 		return err
 	}
+	if r.sync.enabled() {
+		if err = syncDir(filepath.Dir(backupName)); err != nil {
+			fsyncFailed.Add(1)
+			return err
+		}
+	}
+	if r.compressor != nil {
+		r.compressor.Compress(backupName)
+	}
 	return nil
 }
 
+// backupExists reports whether backup with name exists, compressed or not.
+func (r *RotateLogWriter) backupExists(name string) bool {
+	if bs, err := os.Stat(name); err == nil && bs.Size() > 0 {
+		return true
+	}
+	if r.compressor == nil {
+		return false
+	}
+	_, err := os.Stat(name + r.compressor.Ext())
+	return err == nil
+}
+
+// writeFile writes p to current file, through buffer in buffered mode.
+func (r *RotateLogWriter) writeFile(p []byte) (int, error) {
+	if r.bufferSize <= 0 {
+		return r.currentFile.Write(p)
+	}
+	if len(r.buffer)+len(p) > r.bufferSize {
+		if err := r.flushBuffer(); err != nil {
+			return 0, err
+		}
+		if len(p) >= r.bufferSize {
+			return r.currentFile.Write(p)
+		}
+	}
+	r.buffer = append(r.buffer, p...)
+	if !r.flusherRunning {
+		r.flusherRunning = true
+		go r.flusher()
+	}
+	return len(p), nil
+}
+
+// flushBuffer writes buffered data to current file, data which failed to be written is kept.
+// Have to call with lock held.
+func (r *RotateLogWriter) flushBuffer() error {
+	if len(r.buffer) == 0 {
+		return nil
+	}
+	if r.currentFile == nil {
+		return errBufferNotWritten
+	}
+	n, err := r.currentFile.Write(r.buffer)
+	r.buffer = r.buffer[:copy(r.buffer, r.buffer[n:])]
+	return err
+}
+
+// flusher writes buffer every flush interval, it exits when buffer stays empty for an interval
+// or no file is open, the next write opens a file and starts it again.
+func (r *RotateLogWriter) flusher() {
+	t := time.NewTicker(r.flushInterval)
+	defer t.Stop()
+	for range t.C {
+		r.lock.Lock()
+		if len(r.buffer) == 0 || r.currentFile == nil {
+			r.flusherRunning = false
+			r.lock.Unlock()
+			return
+		}
+		if err := r.flushBuffer(); err != nil {
+			r.l.Errorw("flush buffer failed", "file", r.currentFileName, "buffered", len(r.buffer), "err", err)
+		}
+		r.lock.Unlock()
+	}
+}
+
+// Flush writes buffered data to current file.
+func (r *RotateLogWriter) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.flushBuffer()
+}
+
 // have to call from func that keep lock object
 func (r *RotateLogWriter) close() error {
 	defer func() {
 		r.currentWrite = 0
 		r.currentFile = nil
+		r.unsynced = 0
 	}()
 	if r.currentFile != nil {
+		if err := r.flushBuffer(); err != nil {
+			_ = r.currentFile.Close()
+			return err
+		}
+		if r.sync.enabled() && r.unsynced > 0 {
+			if err := r.currentFile.Sync(); err != nil {
+				fsyncFailed.Add(1)
+				_ = r.currentFile.Close()
+				return err
+			}
+		}
 		return r.currentFile.Close()
 	}
 	return nil
 }
 
+// syncFile fsyncs current file, have to call with lock held.
+func (r *RotateLogWriter) syncFile() error {
+	if err := r.flushBuffer(); err != nil {
+		return err
+	}
+	if r.currentFile == nil || r.unsynced == 0 {
+		return nil
+	}
+	if err := r.currentFile.Sync(); err != nil {
+		fsyncFailed.Add(1)
+		return err
+	}
+	r.unsynced = 0
+	return nil
+}
+
+// syncLater is the timed fsync after a write.
+func (r *RotateLogWriter) syncLater() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.syncScheduled = false
+	if err := r.syncFile(); err != nil {
+		r.l.Errorw("fsync failed", "file", r.currentFileName, "err", err)
+	}
+}
+
+// Sync fsyncs data written so far to disk.
+func (r *RotateLogWriter) Sync() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.syncFile()
+}
+
+// rotateIfExpired rotates current file if it is older than max age or idle for too long, a
+// file closed while idle is rotated too.
+func (r *RotateLogWriter) rotateIfExpired(now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.currentFileName == "" || !r.policy.expired(r.openedAt, r.lastWrite, now) {
+		return nil
+	}
+	return r.rotate()
+}
+
+// usage returns time of last write, whether a file is open and whether a file is written but
+// not rotated yet, open or not.
+func (r *RotateLogWriter) usage() (lastWrite time.Time, open bool, pending bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastWrite, r.currentFile != nil, r.currentFileName != ""
+}
+
+// current returns path of the open file, or empty if no file is open.
+func (r *RotateLogWriter) current() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.currentFile == nil {
+		return ""
+	}
+	return r.currentFileName
+}
+
 func (r *RotateLogWriter) Rotate() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	return r.rotate()
 }
 
+// Close writes buffered data and closes current file, it fails if buffered data is left unwritten.
 func (r *RotateLogWriter) Close() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	return r.close()
+	if err := r.close(); err != nil {
+		return err
+	}
+	if len(r.buffer) > 0 {
+		return fmt.Errorf("%d bytes of %s - %w", len(r.buffer), r.currentFileName, errBufferNotWritten)
+	}
+	return nil
 }
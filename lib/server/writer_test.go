@@ -1,15 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/KyberNetwork/cclog/lib/common"
 )
 
 func TestNewRotateLogWriter(t *testing.T) {
-	w := NewRotateLogWriter("./", "test.log", 300)
+	w := NewRotateLogWriter(t.TempDir(), "test.log", 300)
 	for i := 0; i < 10; i++ {
 		_, err := fmt.Fprintln(w, time.Now().String())
 		require.NoError(t, err)
@@ -17,3 +23,237 @@ func TestNewRotateLogWriter(t *testing.T) {
 	err := w.Close()
 	require.NoError(t, err)
 }
+
+func TestBufferedWriter(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	w := newRotateLogWriter(RotationPolicy{MaxLines: 100}, func(time.Time) string {
+		return file
+	}, func(current string, _, _ time.Time) string {
+		return filepath.Join(dir, "app-1.log")
+	})
+	w.bufferSize = 16
+	w.flushInterval = 20 * time.Millisecond
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(name)
+		return string(data)
+	}
+
+	_, err := w.Write([]byte("a\n"))
+	require.NoError(t, err)
+	require.Equal(t, "", read(file))
+	// flusher writes buffer in background
+	require.Eventually(t, func() bool {
+		return read(file) == "a\n"
+	}, time.Second, 5*time.Millisecond)
+
+	// full buffer is written before new data, data as big as buffer is written directly
+	_, err = w.Write([]byte("bbbbbbbbbbbbb\n"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("cc\n"))
+	require.NoError(t, err)
+	require.Equal(t, "a\nbbbbbbbbbbbbb\n", read(file))
+	_, err = w.Write(bytes.Repeat([]byte("d"), 20))
+	require.NoError(t, err)
+	require.Equal(t, "a\nbbbbbbbbbbbbb\ncc\n"+string(bytes.Repeat([]byte("d"), 20)), read(file))
+
+	// rotation and close write buffered data first
+	_, err = w.Write([]byte("e\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Rotate())
+	require.Contains(t, read(filepath.Join(dir, "app-1.log")), "e\n")
+	_, err = w.Write([]byte("f\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "f\n", read(file))
+
+	// data which can't be written is kept for the next file, flusher stops meanwhile
+	_, err = w.Write([]byte("g\n"))
+	require.NoError(t, err)
+	w.lock.Lock()
+	require.NoError(t, w.currentFile.Close())
+	w.lock.Unlock()
+	require.Error(t, w.Rotate())
+	require.Eventually(t, func() bool {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return !w.flusherRunning
+	}, time.Second, 5*time.Millisecond)
+	require.Error(t, w.Flush())
+	_, err = w.Write([]byte("h\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "f\ng\nh\n", read(file))
+}
+
+func TestWriterManClose(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWriterMan(dir, 1<<30, WithBuffer(1<<20, time.Hour))
+	_, err := wm.GetOrCreate("a").Write([]byte("a\n"))
+	require.NoError(t, err)
+	file := filepath.Join(dir, "a", "a.log")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "", string(data))
+	require.NoError(t, wm.Close())
+	data, err = ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "a\n", string(data))
+}
+
+func TestAckFlushesBuffer(t *testing.T) {
+	dir := t.TempDir()
+	srv := NewServer("127.0.0.1:0", NewWriterMan(dir, 1<<30, WithBuffer(1<<20, time.Hour)))
+	require.NoError(t, srv.Listen())
+	defer srv.Shutdown()
+	go func() {
+		_ = srv.Serve()
+	}()
+	conn, _ := connectSession(t, srv.Addr().String(), 0)
+	defer conn.Close()
+	require.NoError(t, common.WriteDataFrame(conn, 1, []byte("1\n")))
+	waitAck(t, conn, 1)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "1\n", string(data))
+}
+
+func TestServerShutdown(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWriterMan(dir, 1<<30, WithBuffer(1<<20, time.Hour))
+	srv := NewServer("127.0.0.1:0", wm)
+	require.NoError(t, srv.Listen())
+	go func() {
+		_ = srv.Serve()
+	}()
+	conn, _ := connectSession(t, srv.Addr().String(), 0)
+	defer conn.Close()
+	require.NoError(t, common.WriteDataFrame(conn, 1, []byte("1\n")))
+	waitAck(t, conn, 1)
+	require.Len(t, srv.Connections(), 1)
+
+	// connections are closed and handlers returned before writers are closed
+	require.NoError(t, srv.Shutdown())
+	require.Empty(t, srv.Connections())
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := common.ReadFrame(conn, nil)
+	require.Error(t, err)
+	require.NoError(t, srv.Shutdown())
+	require.NoError(t, wm.Close())
+	data, err := ioutil.ReadFile(filepath.Join(dir, "test", "test.log"))
+	require.NoError(t, err)
+	require.Equal(t, "1\n", string(data))
+}
+
+// BenchmarkWriterConnections writes 100 byte lines in 4KB chunks from concurrent connections
+// to a stream.
+func BenchmarkWriterConnections(b *testing.B) {
+	line := append(bytes.Repeat([]byte("x"), 99), '\n')
+	chunk := bytes.Repeat(line, 40)
+	for _, buffered := range []bool{false, true} {
+		for _, conns := range []int{1, 10, 100} {
+			b.Run(fmt.Sprintf("buffered=%v/conns=%d", buffered, conns), func(b *testing.B) {
+				var opts []WriterManOption
+				if buffered {
+					opts = append(opts, WithBuffer(256<<10, defaultFlushInterval))
+				}
+				wm := NewWriterMan(b.TempDir(), 1<<40, opts...)
+				w := wm.GetOrCreate("bench")
+				b.SetBytes(int64(len(chunk)))
+				b.ResetTimer()
+				var wg sync.WaitGroup
+				for i := 0; i < conns; i++ {
+					n := b.N / conns
+					if i < b.N%conns {
+						n++
+					}
+					wg.Add(1)
+					go func(n int) {
+						defer wg.Done()
+						lw := newLineWriter(w, defaultMaxLineLength)
+						for j := 0; j < n; j++ {
+							if _, err := lw.Write(chunk); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}(n)
+				}
+				wg.Wait()
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestWriterManEvict(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWriterMan(dir, 1<<30, WithIdleTimeout(time.Minute))
+	used := wm.Acquire(ConnectionInfo{Name: "used"})
+	idle := wm.GetOrCreate("idle")
+	for _, w := range []*RotateLogWriter{used, idle} {
+		_, err := w.Write([]byte("day1\n"))
+		require.NoError(t, err)
+	}
+	first := idle.firstWrite
+	wm.evict(time.Now(), 0)
+	require.NotEqual(t, "", idle.current())
+
+	// writer used by a connection is kept open, idle file is closed but its writer is kept until
+	// the file is rotated
+	wm.evict(time.Now().Add(time.Minute), 0)
+	require.Equal(t, "", idle.current())
+	require.Same(t, idle, wm.GetOrCreate("idle"))
+	require.NotEqual(t, "", used.current())
+
+	// closed file is still rotated by schedule, reopened one keeps its time range
+	_, err := idle.Write([]byte("day1 again\n"))
+	require.NoError(t, err)
+	require.Equal(t, first, idle.firstWrite)
+	wm.evict(time.Now().Add(2*time.Minute), 0)
+	wm.scheduledRotate(DefaultSchedule)
+	require.Eventually(t, func() bool {
+		_, _, pending := idle.usage()
+		return !pending
+	}, time.Second, 5*time.Millisecond)
+	_, err = idle.Write([]byte("day2\n"))
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "idle", "idle.log"))
+	require.NoError(t, err)
+	require.Equal(t, "day2\n", string(data))
+
+	// writer is removed once nothing is left to rotate
+	require.NoError(t, idle.Rotate())
+	wm.evict(time.Now().Add(2*time.Minute), 0)
+	require.NotSame(t, idle, wm.GetOrCreate("idle"))
+
+	wm.Release(used)
+	wm.evict(time.Now().Add(time.Minute), 0)
+	require.Equal(t, "", used.current())
+}
+
+func TestWriterManMaxOpenFiles(t *testing.T) {
+	wm := NewWriterMan(t.TempDir(), 1<<30, WithMaxOpenFiles(2))
+	var writers []*RotateLogWriter
+	for _, name := range []string{"a", "b"} {
+		w := wm.Acquire(ConnectionInfo{Name: name})
+		_, err := w.Write([]byte("line\n"))
+		require.NoError(t, err)
+		writers = append(writers, w)
+		time.Sleep(time.Millisecond)
+	}
+	// all writers are used, none is closed
+	c := wm.Acquire(ConnectionInfo{Name: "c"})
+	require.NotEqual(t, "", writers[0].current())
+	require.NotEqual(t, "", writers[1].current())
+	wm.Release(c)
+
+	// least recently used writer is closed
+	wm.Release(writers[1])
+	wm.Release(writers[0])
+	wm.Acquire(ConnectionInfo{Name: "d"})
+	require.NotEqual(t, "", writers[0].current())
+	require.Equal(t, "", writers[1].current())
+}
@@ -2,50 +2,351 @@ package server
 
 import (
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
 )
 
+const defaultFlushInterval = 100 * time.Millisecond
+
 type WriterMan struct {
 	allWriter   map[string]*RotateLogWriter
 	lock        sync.Mutex
+	l           *zap.SugaredLogger
 	baseDir     string
 	maxFileSize uint64
+	layout      *Layout
+	// compressor compresses rotated files if set.
+	compressor *Compressor
+	// bufferSize enables buffered mode of writers if > 0, flushInterval is how often buffers
+	// are written to files.
+	bufferSize    int
+	flushInterval time.Duration
+	// loc is time zone of rotation schedules and times in file names.
+	loc *time.Location
+	// policyFn returns rotation policy of a stream name, merged with the default policy.
+	policyFn func(name string) RotationPolicy
+	// syncFn returns durability policy of a stream name.
+	syncFn func(name string) SyncPolicy
+	cron   *cron.Cron
+	// schedules are cron specs which are already registered.
+	schedules map[string]bool
+	// idleTimeout closes files of writers which are not used for this long, maxOpen caps open
+	// files by closing least recently used writers. Writers acquired by connections are never
+	// evicted.
+	idleTimeout time.Duration
+	maxOpen     int
+	// stop ends background checks when WriterMan is closed.
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// WriterManOption configures optional features of WriterMan.
+type WriterManOption func(*WriterMan)
+
+// WithLayout sets templates of log file and backup paths.
+func WithLayout(layout *Layout) WriterManOption {
+	return func(w *WriterMan) {
+		w.layout = layout
+	}
+}
+
+// WithLocation sets time zone of rotation schedules and times in file names, default is UTC.
+func WithLocation(loc *time.Location) WriterManOption {
+	return func(w *WriterMan) {
+		w.loc = loc
+	}
+}
+
+// WithCompressor compresses rotated files by c.
+func WithCompressor(c *Compressor) WriterManOption {
+	return func(w *WriterMan) {
+		w.compressor = c
+	}
+}
+
+// WithSync sets when files of each stream name are fsynced, files aren't fsynced by default.
+func WithSync(fn func(name string) SyncPolicy) WriterManOption {
+	return func(w *WriterMan) {
+		w.syncFn = fn
+	}
+}
+
+// WithBuffer makes writers buffer up to size bytes in memory and write them every flushInterval
+// or when buffer is full, which saves syscalls when many connections write to a stream.
+func WithBuffer(size int, flushInterval time.Duration) WriterManOption {
+	return func(w *WriterMan) {
+		w.bufferSize = size
+		w.flushInterval = flushInterval
+	}
 }
 
-func NewWriterMan(baseDir string, maxFileSize uint64) *WriterMan {
+// WithIdleTimeout closes files of writers which are not written for d and not used by any
+// connection, they are reopened on next write. Idle files are kept open by default.
+func WithIdleTimeout(d time.Duration) WriterManOption {
+	return func(w *WriterMan) {
+		w.idleTimeout = d
+	}
+}
+
+// WithMaxOpenFiles caps open log files, least recently used writers which are not used by any
+// connection are closed when it is reached.
+func WithMaxOpenFiles(n int) WriterManOption {
+	return func(w *WriterMan) {
+		w.maxOpen = n
+	}
+}
+
+// WithRotation sets rotation policy of each stream name, zero fields inherit the default
+// policy which rotates daily and at max file size.
+func WithRotation(fn func(name string) RotationPolicy) WriterManOption {
+	return func(w *WriterMan) {
+		w.policyFn = fn
+	}
+}
+
+func NewWriterMan(baseDir string, maxFileSize uint64, opts ...WriterManOption) *WriterMan {
+	layout, _ := NewLayout(DefaultFileTemplate, DefaultBackupTemplate)
 	g := &WriterMan{
 		allWriter:   make(map[string]*RotateLogWriter),
+		l:           zap.S(),
 		baseDir:     baseDir,
 		maxFileSize: maxFileSize,
+		layout:      layout,
+		loc:         time.UTC,
+		schedules:   make(map[string]bool),
+		stop:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(g)
 	}
-	c := cron.New()
-	_, _ = c.AddFunc("0 0 * * *", g.dailyRotate)
-	c.Start()
+	if g.flushInterval <= 0 {
+		g.flushInterval = defaultFlushInterval
+	}
+	g.layout = g.layout.WithLocation(g.loc)
+	g.cron = cron.New(cron.WithLocation(g.loc))
+	g.cron.Start()
+	go g.checkExpired()
 	return g
 }
-func (w *WriterMan) dailyRotate() {
+
+// policy returns rotation policy of stream name.
+func (w *WriterMan) policy(name string) RotationPolicy {
+	def := RotationPolicy{Schedule: DefaultSchedule, MaxSize: w.maxFileSize}
+	if w.policyFn == nil {
+		return def
+	}
+	return w.policyFn(name).merge(def)
+}
+
+// schedule registers cron spec once, have to call with lock held.
+func (w *WriterMan) schedule(spec string) {
+	if spec == "" || w.schedules[spec] {
+		return
+	}
+	if _, err := w.cron.AddFunc(spec, func() { w.scheduledRotate(spec) }); err != nil {
+		w.l.Errorw("invalid rotation schedule", "schedule", spec, "err", err)
+		return
+	}
+	w.schedules[spec] = true
+}
+
+// scheduledRotate rotates writers with schedule spec.
+func (w *WriterMan) scheduledRotate(spec string) {
 	var aw []*RotateLogWriter
 	w.lock.Lock()
 	for _, o := range w.allWriter {
-		aw = append(aw, o)
+		if o.policy.scheduled() == spec {
+			aw = append(aw, o)
+		}
 	}
 	w.lock.Unlock()
 	for _, o := range aw {
 		o := o
 		go func() {
-			_ = o.Rotate()
+			if err := o.Rotate(); err != nil {
+				w.l.Errorw("scheduled rotate failed", "schedule", spec, "err", err)
+			}
 		}()
 	}
 }
+
+// checkExpired rotates files which are too old or idle.
+func (w *WriterMan) checkExpired() {
+	t := time.NewTicker(rotateCheckInterval)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-w.stop:
+			return
+		}
+		var aw []*RotateLogWriter
+		w.lock.Lock()
+		for _, o := range w.allWriter {
+			if o.policy.MaxAge > 0 || o.policy.Idle > 0 {
+				aw = append(aw, o)
+			}
+		}
+		w.lock.Unlock()
+		for _, o := range aw {
+			if err := o.rotateIfExpired(now); err != nil {
+				w.l.Errorw("rotate expired file failed", "err", err)
+			}
+		}
+		if w.idleTimeout > 0 || w.maxOpen > 0 {
+			w.evict(now, 0)
+		}
+	}
+}
+
+// evict closes files of writers without references which are idle, then of least recently used
+// ones until open files plus reserve are within the cap. A writer whose file is not rotated yet is
+// kept, so the file is still rotated by its schedule and reopened with its state on next write,
+// other idle writers are removed.
+func (w *WriterMan) evict(now time.Time, reserve int) {
+	type candidate struct {
+		key     string
+		w       *RotateLogWriter
+		used    time.Time
+		open    bool
+		pending bool
+	}
+	var (
+		candidates []candidate
+		open       int
+		victims    []*RotateLogWriter
+	)
+	w.lock.Lock()
+	for key, o := range w.allWriter {
+		lastWrite, isOpen, pending := o.usage()
+		if isOpen {
+			open++
+		}
+		if o.refs > 0 {
+			continue
+		}
+		used := o.lastUsed
+		if lastWrite.After(used) {
+			used = lastWrite
+		}
+		candidates = append(candidates, candidate{key: key, w: o, used: used, open: isOpen, pending: pending})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].used.Before(candidates[j].used)
+	})
+	for _, c := range candidates {
+		idle := w.idleTimeout > 0 && now.Sub(c.used) >= w.idleTimeout
+		overCap := w.maxOpen > 0 && c.open && open+reserve > w.maxOpen
+		if !idle && !overCap {
+			continue
+		}
+		if !c.pending {
+			delete(w.allWriter, c.key)
+		}
+		if c.open {
+			victims = append(victims, c.w)
+			open--
+		}
+	}
+	if reserve > 0 && w.maxOpen > 0 && open+reserve > w.maxOpen {
+		w.l.Warnw("open log files exceed max, all are used by connections", "open", open+reserve, "max", w.maxOpen)
+	}
+	w.lock.Unlock()
+	writersEvicted.Add(int64(len(victims)))
+	for _, o := range victims {
+		if err := o.Close(); err != nil {
+			w.l.Errorw("close evicted writer failed", "err", err)
+		}
+	}
+}
+
+// Close stops scheduled rotation, writes buffered data and closes files of all writers, then waits
+// for compressions of rotated files. It is called when server stops, so data acknowledged to
+// clients is not lost.
+func (w *WriterMan) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.cron.Stop().Done()
+		w.lock.Lock()
+		aw := make([]*RotateLogWriter, 0, len(w.allWriter))
+		for _, o := range w.allWriter {
+			aw = append(aw, o)
+		}
+		w.lock.Unlock()
+		for _, o := range aw {
+			if cerr := o.Close(); cerr != nil {
+				w.l.Errorw("close log file failed", "err", cerr)
+				err = cerr
+			}
+		}
+		if w.compressor != nil {
+			w.compressor.Wait()
+		}
+	})
+	return err
+}
+
+// GetOrCreate returns writer of stream name for a client without host or labels.
 func (w *WriterMan) GetOrCreate(name string) *RotateLogWriter {
+	return w.GetOrCreateFor(ConnectionInfo{Name: name})
+}
+
+// GetOrCreateFor returns writer of the file layout renders for a connection, connections
+// with the same rendered path share a writer. The writer can be evicted when idle, use Acquire
+// to keep it.
+func (w *WriterMan) GetOrCreateFor(info ConnectionInfo) *RotateLogWriter {
+	res, _ := w.getOrCreate(info, 0)
+	return res
+}
+
+// Acquire returns writer like GetOrCreateFor and keeps it from being evicted until Release.
+func (w *WriterMan) Acquire(info ConnectionInfo) *RotateLogWriter {
+	res, created := w.getOrCreate(info, 1)
+	if created && w.maxOpen > 0 {
+		// make room for the file new writer will open
+		w.evict(time.Now(), 1)
+	}
+	return res
+}
+
+// Release marks writer acquired by Acquire as no longer used by the caller.
+func (w *WriterMan) Release(r *RotateLogWriter) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	r.refs--
+	r.lastUsed = time.Now()
+}
+
+// getOrCreate returns writer for a connection adding refs to its references, and whether it was
+// created.
+func (w *WriterMan) getOrCreate(info ConnectionInfo, refs int) (*RotateLogWriter, bool) {
+	vars := streamVarsOf(info)
+	key := w.layout.key(vars)
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	res, ok := w.allWriter[name]
+	res, ok := w.allWriter[key]
 	if !ok {
-		res = NewRotateLogWriter(filepath.Join(w.baseDir, name), name+".log", w.maxFileSize)
-		w.allWriter[name] = res
+		layout := w.layout
+		policy := w.policy(info.Name)
+		res = newRotateLogWriter(policy, func(t time.Time) string {
+			return filepath.Join(w.baseDir, layout.path(vars, t))
+		}, layout.backupPath)
+		res.compressor = w.compressor
+		res.bufferSize = w.bufferSize
+		res.flushInterval = w.flushInterval
+		if w.syncFn != nil {
+			res.sync = w.syncFn(info.Name)
+		}
+		w.schedule(policy.scheduled())
+		w.allWriter[key] = res
 	}
-	return res
+	res.refs += refs
+	res.lastUsed = time.Now()
+	return res, !ok
 }